@@ -0,0 +1,110 @@
+package alert
+
+/*
+ * This file builds rules and notifiers from the config and delivers events.
+ */
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/notify"
+)
+
+// Rule sources
+const (
+	SourceRealTime = "realtime"
+	SourceTrend    = "trend"
+)
+
+// Rules parses the configured rules for the source
+func Rules(alertsCfg config.AlertsConfig, source string) ([]*Rule, error) {
+	var rules []*Rule
+	for _, ruleCfg := range alertsCfg.Rules {
+		ruleSource := ruleCfg.Source
+		if ruleSource == "" {
+			ruleSource = SourceRealTime
+		}
+		names := RealTimeFieldNames
+		switch ruleSource {
+		case SourceRealTime:
+		case SourceTrend:
+			names = TrendFieldNames
+		default:
+			return nil, fmt.Errorf("alert rule %q: invalid source: %s", ruleCfg.Name, ruleCfg.Source)
+		}
+
+		rule, err := NewRule(ruleCfg.Name, ruleCfg.Expression, names, ruleCfg.Duration, ruleCfg.From, ruleCfg.To)
+		if err != nil {
+			return nil, err
+		}
+		if ruleSource == source {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// Notifiers returns the configured notifiers
+func Notifiers(alertsCfg config.AlertsConfig) []notify.Notifier {
+	var notifiers []notify.Notifier
+	for _, url := range alertsCfg.Webhooks {
+		notifiers = append(notifiers, notify.WebhookNotifier{URL: url})
+	}
+	if smtpCfg := alertsCfg.SMTP; smtpCfg.Host != "" {
+		port := smtpCfg.Port
+		if port == 0 {
+			port = 25
+		}
+		notifiers = append(notifiers, notify.SMTPNotifier{
+			Host:     smtpCfg.Host,
+			Port:     port,
+			Username: smtpCfg.Username,
+			Password: smtpCfg.Password,
+			From:     smtpCfg.From,
+			To:       smtpCfg.To,
+		})
+	}
+	if ntfyCfg := alertsCfg.Ntfy; ntfyCfg.URL != "" {
+		notifiers = append(notifiers, notify.NtfyNotifier{
+			URL:      ntfyCfg.URL,
+			Token:    ntfyCfg.Token,
+			Priority: ntfyCfg.Priority,
+			Tags:     ntfyCfg.Tags,
+		})
+	}
+	return notifiers
+}
+
+// Notify logs the event and sends it to every notifier, returning the number delivered and
+// the last error
+func Notify(event Event, notifiers []notify.Notifier, logger *slog.Logger) (int, error) {
+	if event.State == Raised {
+		logger.Warn("Alert", "rule", event.Rule, "expression", event.Expression, "started", event.Started)
+	} else {
+		logger.Info("Alert resolved", "rule", event.Rule, "expression", event.Expression, "started", event.Started)
+	}
+
+	notification := notify.Notification{
+		Title:   event.Title(),
+		Message: event.Message(),
+		Payload: event,
+	}
+
+	var delivered int
+	var lastErr error
+	for _, notifier := range notifiers {
+		ctx, cancel := context.WithTimeout(context.Background(), notify.Timeout)
+		err := notifier.Notify(ctx, notification)
+		cancel()
+		if err != nil {
+			logger.Error("Alert notification", "notifier", notifier.String(), "rule", event.Rule, "err", err)
+			lastErr = err
+			continue
+		}
+		delivered++
+	}
+	return delivered, lastErr
+}
@@ -0,0 +1,252 @@
+package alert
+
+/*
+ * This file parses and evaluates alert rule expressions.  An expression compares fields
+ * against numbers or other fields, comparisons can be combined with "and", "or", "not" and
+ * parentheses, i.e. "consumption > 8000 and not (production > 100)".
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expression is a parsed alert rule expression
+type Expression struct {
+	source string
+	root   node
+	fields []string
+}
+
+// A node of the expression tree
+type node interface {
+	eval(fields map[string]float64) bool
+}
+
+// Comparison operators
+var comparisons = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// A field name or number
+type operand struct {
+	field string
+	value float64
+}
+
+func (o operand) get(fields map[string]float64) float64 {
+	if o.field != "" {
+		return fields[o.field]
+	}
+	return o.value
+}
+
+type comparison struct {
+	left, right operand
+	compare     func(a, b float64) bool
+}
+
+func (c comparison) eval(fields map[string]float64) bool {
+	return c.compare(c.left.get(fields), c.right.get(fields))
+}
+
+type and struct{ left, right node }
+
+func (n and) eval(fields map[string]float64) bool { return n.left.eval(fields) && n.right.eval(fields) }
+
+type or struct{ left, right node }
+
+func (n or) eval(fields map[string]float64) bool { return n.left.eval(fields) || n.right.eval(fields) }
+
+type not struct{ operand node }
+
+func (n not) eval(fields map[string]float64) bool { return !n.operand.eval(fields) }
+
+// ParseExpression parses an expression, field names must be in names
+func ParseExpression(str string, names []string) (*Expression, error) {
+	tokens, err := tokenize(str)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, names: names}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", str, err)
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("expression %q: unexpected %q", str, p.tokens[p.pos])
+	}
+	return &Expression{source: str, root: root, fields: p.fields}, nil
+}
+
+// Eval evaluates the expression, missing fields are zero
+func (e *Expression) Eval(fields map[string]float64) bool {
+	return e.root.eval(fields)
+}
+
+// Fields returns the names of the fields the expression uses
+func (e *Expression) Fields() []string {
+	return e.fields
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Split the expression into identifiers, numbers, operators and parentheses
+func tokenize(str string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(str); {
+		c := rune(str[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case strings.ContainsRune("<>=!", c):
+			j := i + 1
+			if j < len(str) && str[j] == '=' {
+				j++
+			}
+			tokens = append(tokens, str[i:j])
+			i = j
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '.' || c == '-':
+			j := i + 1
+			for j < len(str) && (unicode.IsLetter(rune(str[j])) || unicode.IsDigit(rune(str[j])) || str[j] == '_' || str[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, str[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("expression %q: unexpected %q", str, c)
+		}
+	}
+	return tokens, nil
+}
+
+// Recursive descent parser, "and" binds tighter than "or"
+type parser struct {
+	tokens []string
+	pos    int
+	names  []string
+	fields []string // Fields used so far
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = or{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "and") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = and{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if strings.EqualFold(p.peek(), "not") {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return not{operand}, nil
+	}
+	if p.peek() == "(" {
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return n, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	compare, ok := comparisons[op]
+	if !ok {
+		return nil, fmt.Errorf("expected comparison, got %q", op)
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return comparison{left: left, right: right, compare: compare}, nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	token := p.next()
+	if token == "" {
+		return operand{}, fmt.Errorf("unexpected end")
+	}
+	if value, err := strconv.ParseFloat(token, 64); err == nil {
+		return operand{value: value}, nil
+	}
+	for _, name := range p.names {
+		if token == name {
+			p.use(token)
+			return operand{field: token}, nil
+		}
+	}
+	return operand{}, fmt.Errorf("unknown field %q, expected one of %s", token, strings.Join(p.names, ", "))
+}
+
+func (p *parser) use(field string) {
+	for _, f := range p.fields {
+		if f == field {
+			return
+		}
+	}
+	p.fields = append(p.fields, field)
+}
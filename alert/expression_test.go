@@ -0,0 +1,105 @@
+package alert
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseExpression(t *testing.T) {
+	fields := map[string]float64{
+		"consumption": 9000,
+		"production":  50,
+		"net":         8950,
+		"voltage1":    118.5,
+		"voltage2":    121,
+	}
+
+	tests := []struct {
+		expression string
+		want       bool
+		fields     []string
+	}{
+		{"consumption > 8000", true, []string{"consumption"}},
+		{"consumption <= 8000", false, []string{"consumption"}},
+		{"production == 50", true, []string{"production"}},
+		{"production != 50", false, []string{"production"}},
+		{"voltage1 < voltage2", true, []string{"voltage1", "voltage2"}},
+		{"net >= -10", true, []string{"net"}},
+		{"8000 < consumption", true, []string{"consumption"}},
+		{"consumption > 8000 and production > 100", false, []string{"consumption", "production"}},
+		{"consumption > 8000 and not (production > 100)", true, []string{"consumption", "production"}},
+		{"consumption > 10000 or production < 100", true, []string{"consumption", "production"}},
+		// "and" binds tighter than "or"
+		{"production > 100 and consumption > 0 or net > 0", true, []string{"production", "consumption", "net"}},
+		{"production > 100 and (consumption > 0 or net > 0)", false, []string{"production", "consumption", "net"}},
+		{"not not consumption > 8000", true, []string{"consumption"}},
+		{"CONSUMPTION > 0", false, nil}, // Field names are case sensitive
+		{"consumption > 0 AND production > 0", true, []string{"consumption", "production"}},
+		{"consumption>8000", true, []string{"consumption"}},
+		{"consumption > 0 and consumption < 10000", true, []string{"consumption"}},
+	}
+	for _, test := range tests {
+		expr, err := ParseExpression(test.expression, RealTimeFieldNames)
+		if test.fields == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.expression)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.expression, err)
+			continue
+		}
+		if got := expr.Eval(fields); got != test.want {
+			t.Errorf("%q = %v, want %v", test.expression, got, test.want)
+		}
+		if !reflect.DeepEqual(expr.Fields(), test.fields) {
+			t.Errorf("%q fields = %v, want %v", test.expression, expr.Fields(), test.fields)
+		}
+		if expr.String() != test.expression {
+			t.Errorf("String() = %q, want %q", expr.String(), test.expression)
+		}
+	}
+}
+
+func TestParseExpressionMissingFields(t *testing.T) {
+	expr, err := ParseExpression("frequency < 59.9", RealTimeFieldNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Missing fields are zero
+	if !expr.Eval(map[string]float64{}) {
+		t.Error("missing field should evaluate as zero")
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		names      []string
+		err        string
+	}{
+		{"", RealTimeFieldNames, "unexpected end"},
+		{"consumption", RealTimeFieldNames, "expected comparison"},
+		{"consumption >", RealTimeFieldNames, "unexpected end"},
+		{"consumption = 5", RealTimeFieldNames, "expected comparison"},
+		{"load > 5", RealTimeFieldNames, `unknown field "load"`},
+		{"voltage1 > 120", TrendFieldNames, `unknown field "voltage1"`}, // Realtime only field
+		{"(consumption > 5", RealTimeFieldNames, "missing )"},
+		{"consumption > 5)", RealTimeFieldNames, `unexpected ")"`},
+		{"consumption > 5 production > 5", RealTimeFieldNames, `unexpected "production"`},
+		{"consumption > 5 and", RealTimeFieldNames, "unexpected end"},
+		{"consumption > $5", RealTimeFieldNames, "unexpected '$'"},
+	}
+	for _, test := range tests {
+		_, err := ParseExpression(test.expression, test.names)
+		if err == nil {
+			t.Errorf("%q: expected an error", test.expression)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: error %q doesn't mention %q", test.expression, err, test.err)
+		}
+	}
+}
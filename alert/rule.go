@@ -0,0 +1,192 @@
+package alert
+
+/*
+ * This file holds threshold alert rules over realtime and trend data.  A rule raises an
+ * alert once its expression has held for the rule's duration, inside an optional time of day
+ * window, and resolves it once the expression no longer holds (or the window ends).
+ */
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/david-lutz/sense_logger/sense"
+)
+
+// Alert event states
+const (
+	Raised   = "alert"
+	Resolved = "resolved"
+)
+
+// RealTimeFieldNames are the fields available to realtime rules (watts, volts, Hz)
+var RealTimeFieldNames = []string{
+	"consumption", "production", "net",
+	"voltage1", "voltage2", "frequency",
+	"channel1", "channel2", "channel3", "channel4",
+}
+
+// TrendFieldNames are the fields available to trend rules (kWh per step)
+var TrendFieldNames = []string{"consumption", "production", "net"}
+
+// RealTimeFields returns the rule fields of a realtime message
+func RealTimeFields(realtime sense.RealTime) map[string]float64 {
+	return map[string]float64{
+		"consumption": realtime.Consumption,
+		"production":  realtime.Production,
+		"net":         realtime.Consumption - realtime.Production,
+		"voltage1":    realtime.Voltage[0],
+		"voltage2":    realtime.Voltage[1],
+		"frequency":   realtime.Frequency,
+		"channel1":    realtime.Channels[0],
+		"channel2":    realtime.Channels[1],
+		"channel3":    realtime.Channels[2],
+		"channel4":    realtime.Channels[3],
+	}
+}
+
+// TrendFields returns the rule fields of a trend record
+func TrendFields(record sense.TrendRecord) map[string]float64 {
+	return map[string]float64{
+		"consumption": record.Consumption,
+		"production":  record.Production,
+		"net":         record.Consumption - record.Production,
+	}
+}
+
+// Event is an alert being raised or resolved
+type Event struct {
+	Rule       string             `json:"rule"`
+	Expression string             `json:"expression"`
+	State      string             `json:"state"`
+	Started    time.Time          `json:"started"` // When the expression started holding
+	Timestamp  time.Time          `json:"timestamp"`
+	Values     map[string]float64 `json:"values"` // Fields used by the expression
+}
+
+// Title is a one line summary of the event
+func (e Event) Title() string {
+	if e.State == Raised {
+		return fmt.Sprintf("Sense alert: %s", e.Rule)
+	}
+	return fmt.Sprintf("Sense alert resolved: %s", e.Rule)
+}
+
+// Message describes the event and the values that triggered it
+func (e Event) Message() string {
+	names := make([]string, 0, len(e.Values))
+	for name := range e.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	if e.State == Raised {
+		fmt.Fprintf(&b, "%s since %s\n", e.Expression, e.Started.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(&b, "%s no longer holds after %s\n", e.Expression, e.Timestamp.Sub(e.Started).Round(time.Second))
+	}
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s = %g\n", name, e.Values[name])
+	}
+	return b.String()
+}
+
+// Time of day window, minutes since midnight
+type window struct {
+	from, to int
+}
+
+func parseTimeOfDay(str string) (int, error) {
+	t, err := time.Parse("15:04", str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", str)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Windows may wrap past midnight, i.e. 22:00 to 06:00
+func (w window) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return minute >= w.from && minute < w.to
+	}
+	return minute >= w.from || minute < w.to
+}
+
+// Rule is a threshold alert rule and its state
+type Rule struct {
+	Name       string
+	Expression *Expression
+	Duration   time.Duration
+	window     *window
+
+	holding bool      // Expression held on the last check
+	since   time.Time // When the expression started holding
+	active  bool      // Alert raised
+}
+
+// NewRule parses a rule.  from and to are an optional "HH:MM" time of day window, checked
+// against the local time of each sample.
+func NewRule(name, expression string, names []string, duration time.Duration, from, to string) (*Rule, error) {
+	expr, err := ParseExpression(expression, names)
+	if err != nil {
+		return nil, fmt.Errorf("alert rule %q: %w", name, err)
+	}
+	r := &Rule{Name: name, Expression: expr, Duration: duration}
+	if r.Name == "" {
+		r.Name = expression
+	}
+
+	if from != "" || to != "" {
+		r.window = &window{}
+		if r.window.from, err = parseTimeOfDay(from); err != nil {
+			return nil, fmt.Errorf("alert rule %q: %w", name, err)
+		}
+		if r.window.to, err = parseTimeOfDay(to); err != nil {
+			return nil, fmt.Errorf("alert rule %q: %w", name, err)
+		}
+	}
+	return r, nil
+}
+
+// Check a sample taken at t, returning an event when the alert is raised or resolved
+func (r *Rule) Check(t time.Time, fields map[string]float64) *Event {
+	holds := (r.window == nil || r.window.contains(t)) && r.Expression.Eval(fields)
+
+	if !holds {
+		r.holding = false
+		if r.active {
+			r.active = false
+			return r.event(Resolved, t, fields)
+		}
+		return nil
+	}
+
+	if !r.holding {
+		r.holding, r.since = true, t
+	}
+	if !r.active && t.Sub(r.since) >= r.Duration {
+		r.active = true
+		return r.event(Raised, t, fields)
+	}
+	return nil
+}
+
+func (r *Rule) event(state string, t time.Time, fields map[string]float64) *Event {
+	// Just the values the expression looks at
+	values := make(map[string]float64)
+	for _, name := range r.Expression.Fields() {
+		values[name] = fields[name]
+	}
+	return &Event{
+		Rule:       r.Name,
+		Expression: r.Expression.String(),
+		State:      state,
+		Started:    r.since,
+		Timestamp:  t,
+		Values:     values,
+	}
+}
@@ -0,0 +1,125 @@
+package alert
+
+import (
+	"testing"
+	"time"
+)
+
+// One sample fed to a rule and the event state expected back ("" for no event)
+type ruleStep struct {
+	offset      time.Duration
+	consumption float64
+	want        string
+}
+
+func runRule(t *testing.T, rule *Rule, start time.Time, steps []ruleStep) []*Event {
+	t.Helper()
+	var events []*Event
+	for i, step := range steps {
+		event := rule.Check(start.Add(step.offset), map[string]float64{"consumption": step.consumption})
+		got := ""
+		if event != nil {
+			got = event.State
+			events = append(events, event)
+		}
+		if got != step.want {
+			t.Errorf("step %d (+%s, consumption %g): event %q, want %q", i, step.offset, step.consumption, got, step.want)
+		}
+	}
+	return events
+}
+
+func TestRuleDuration(t *testing.T) {
+	rule, err := NewRule("high load", "consumption > 8000", RealTimeFieldNames, 5*time.Minute, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	events := runRule(t, rule, start, []ruleStep{
+		{0, 9000, ""},
+		{2 * time.Minute, 9000, ""},
+		{3 * time.Minute, 7000, ""}, // Dropped below before the duration, restarts the hold
+		{4 * time.Minute, 9000, ""},
+		{8 * time.Minute, 9000, ""},
+		{9 * time.Minute, 9000, Raised}, // Held for 5 minutes since +4m
+		{10 * time.Minute, 9500, ""},    // Already raised
+		{12 * time.Minute, 100, Resolved},
+		{13 * time.Minute, 100, ""},
+	})
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+
+	raised, resolved := events[0], events[1]
+	if !raised.Started.Equal(start.Add(4*time.Minute)) || !raised.Timestamp.Equal(start.Add(9*time.Minute)) {
+		t.Errorf("raised started %s at %s", raised.Started, raised.Timestamp)
+	}
+	if !resolved.Started.Equal(raised.Started) || !resolved.Timestamp.Equal(start.Add(12*time.Minute)) {
+		t.Errorf("resolved started %s at %s", resolved.Started, resolved.Timestamp)
+	}
+	if raised.Rule != "high load" || raised.Expression != "consumption > 8000" {
+		t.Errorf("raised rule %q expression %q", raised.Rule, raised.Expression)
+	}
+	if len(raised.Values) != 1 || raised.Values["consumption"] != 9000 {
+		t.Errorf("raised values = %v", raised.Values)
+	}
+}
+
+func TestRuleNoDuration(t *testing.T) {
+	rule, err := NewRule("", "consumption > 8000", RealTimeFieldNames, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Name != "consumption > 8000" {
+		t.Errorf("unnamed rule is called %q, want the expression", rule.Name)
+	}
+
+	runRule(t, rule, time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC), []ruleStep{
+		{0, 9000, Raised},
+		{time.Second, 100, Resolved},
+		{2 * time.Second, 9000, Raised},
+	})
+}
+
+func TestRuleWindow(t *testing.T) {
+	// Overnight window wrapping past midnight
+	rule, err := NewRule("night load", "consumption > 1000", RealTimeFieldNames, 10*time.Minute, "22:00", "06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 7, 1, 21, 50, 0, 0, time.UTC)
+
+	runRule(t, rule, start, []ruleStep{
+		{0, 2000, ""},                                  // 21:50, before the window
+		{5 * time.Minute, 2000, ""},                    // 21:55
+		{10 * time.Minute, 2000, ""},                   // 22:00, the hold starts here
+		{15 * time.Minute, 2000, ""},                   // 22:05
+		{20 * time.Minute, 2000, Raised},               // 22:10
+		{2 * time.Hour, 2000, ""},                      // 23:50
+		{3 * time.Hour, 2000, ""},                      // 00:50, still inside after midnight
+		{8 * time.Hour, 2000, ""},                      // 05:50
+		{8*time.Hour + 10*time.Minute, 2000, Resolved}, // 06:00, the window ended
+		{9 * time.Hour, 2000, ""},                      // 06:50
+	})
+}
+
+func TestRuleInvalid(t *testing.T) {
+	tests := []struct {
+		name, expression, from, to string
+	}{
+		{"bad expression", "consumption >", "", ""},
+		{"bad from", "consumption > 0", "10pm", "06:00"},
+		{"missing to", "consumption > 0", "22:00", ""},
+		{"trend field", "voltage1 > 0", "", ""},
+	}
+	for _, test := range tests {
+		names := RealTimeFieldNames
+		if test.name == "trend field" {
+			names = TrendFieldNames
+		}
+		if _, err := NewRule(test.name, test.expression, names, 0, test.from, test.to); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package carbon
+
+/*
+ * This file estimates CO2 emissions from trend data using a grid emission factor schedule:
+ * a static factor, an hourly profile, or grid intensity loaded from a local CSV file.
+ */
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/store"
+	"github.com/mitchellh/go-homedir"
+)
+
+// Timestamp layouts accepted in the CSV file, the ones without a zone are local time
+var csvLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+
+// One CSV row, the factor applies from Start until the next row
+type intensity struct {
+	start  time.Time
+	factor float64
+}
+
+// Schedule returns the emission factor (kg CO2 per kWh) in effect at any time
+type Schedule struct {
+	location    *time.Location
+	static      float64
+	hourly      []float64
+	intensities []intensity
+}
+
+// New builds the schedule from the config, hours and CSV timestamps without a zone are in
+// the location.  Returns nil if no factors are configured.
+func New(carbonCfg config.CarbonConfig, location *time.Location) (*Schedule, error) {
+	if carbonCfg.Factor == 0 && len(carbonCfg.Hourly) == 0 && carbonCfg.File == "" {
+		return nil, nil
+	}
+	if len(carbonCfg.Hourly) != 0 && len(carbonCfg.Hourly) != 24 {
+		return nil, fmt.Errorf("hourly carbon profile needs 24 factors, got %d", len(carbonCfg.Hourly))
+	}
+
+	s := &Schedule{
+		location: location,
+		static:   carbonCfg.Factor,
+		hourly:   carbonCfg.Hourly,
+	}
+	if carbonCfg.File != "" {
+		filename, err := homedir.Expand(carbonCfg.File)
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if s.intensities, err = readCSV(file, location); err != nil {
+			return nil, fmt.Errorf("%s: %w", carbonCfg.File, err)
+		}
+	}
+	return s, nil
+}
+
+// Read timestamp,factor rows, skipping a header row and sorting by time
+func readCSV(r io.Reader, location *time.Location) ([]intensity, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var intensities []intensity
+	for i, record := range records {
+		if len(record) < 2 {
+			return nil, fmt.Errorf("line %d: expected timestamp,factor", i+1)
+		}
+		factor, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil {
+			if i == 0 {
+				continue // Header
+			}
+			return nil, fmt.Errorf("line %d: invalid factor %q", i+1, record[1])
+		}
+		start, err := parseTimestamp(strings.TrimSpace(record[0]), location)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		intensities = append(intensities, intensity{start: start, factor: factor})
+	}
+
+	sort.Slice(intensities, func(i, j int) bool { return intensities[i].start.Before(intensities[j].start) })
+	return intensities, nil
+}
+
+func parseTimestamp(str string, location *time.Location) (time.Time, error) {
+	for _, layout := range csvLayouts {
+		if t, err := time.ParseInLocation(layout, str, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", str)
+}
+
+// Factor returns the emission factor (kg CO2 per kWh) in effect at t, ok is false if no
+// factor covers t (before the first CSV row with no hourly profile or static factor)
+func (s *Schedule) Factor(t time.Time) (factor float64, ok bool) {
+	// Last CSV row at or before t
+	i := sort.Search(len(s.intensities), func(i int) bool { return s.intensities[i].start.After(t) })
+	if i > 0 {
+		return s.intensities[i-1].factor, true
+	}
+	if len(s.hourly) == 24 {
+		return s.hourly[t.In(s.location).Hour()], true
+	}
+	return s.static, s.static != 0
+}
+
+// Emissions holds the energy and estimated CO2 for a step or a total, consumption is what
+// the house used and grid import is the part of it that came from the grid
+type Emissions struct {
+	Start       time.Time
+	Consumption float64 // kWh
+	GridImport  float64 // kWh
+	CO2         float64 // kg, for consumption
+	CO2Import   float64 // kg, for grid import
+}
+
+// Estimate the emissions of one trend step, production is the cooked production.  ok is
+// false if no factor covers the step.
+func (s *Schedule) Estimate(t time.Time, consumption, production float64) (Emissions, bool) {
+	factor, ok := s.Factor(t)
+	if !ok {
+		return Emissions{}, false
+	}
+	gridImport := sense.Split(consumption, production).GridImport
+	return Emissions{
+		Start:       t,
+		Consumption: consumption,
+		GridImport:  gridImport,
+		CO2:         consumption * factor,
+		CO2Import:   gridImport * factor,
+	}, true
+}
+
+// Monthly totals the emissions of trend rows by local calendar month.  The rows should be
+// hourly (DAY scale) so the hourly factors line up.  Rows no factor covers are left out of
+// the totals and counted in skipped.
+func (s *Schedule) Monthly(rows []store.TrendRow) (months []Emissions, skipped int) {
+	for _, row := range rows {
+		e, ok := s.Estimate(row.Time, row.Consumption, row.Production)
+		if !ok {
+			skipped++
+			continue
+		}
+
+		local := row.Time.In(s.location)
+		month := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, s.location)
+		if len(months) == 0 || !months[len(months)-1].Start.Equal(month) {
+			months = append(months, Emissions{Start: month})
+		}
+
+		total := &months[len(months)-1]
+		total.Consumption += e.Consumption
+		total.GridImport += e.GridImport
+		total.CO2 += e.CO2
+		total.CO2Import += e.CO2Import
+	}
+	return months, skipped
+}
@@ -0,0 +1,136 @@
+package carbon
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/store"
+)
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone data: %v", err)
+	}
+	return location
+}
+
+func TestReadCSV(t *testing.T) {
+	denver := loadLocation(t, "America/Denver")
+	csv := `timestamp,factor
+2026-07-02 00:00, 0.30
+2026-07-01T12:00:00Z,0.50
+2026-07-01T05:00,0.40
+2026-07-03,0.20
+`
+	intensities, err := readCSV(strings.NewReader(csv), denver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []intensity{
+		{time.Date(2026, 7, 1, 5, 0, 0, 0, denver), 0.40}, // Zone-less timestamps are local, 11:00 UTC
+		{time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC), 0.50},
+		{time.Date(2026, 7, 2, 0, 0, 0, 0, denver), 0.30},
+		{time.Date(2026, 7, 3, 0, 0, 0, 0, denver), 0.20},
+	}
+	if len(intensities) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(intensities), len(want))
+	}
+	for i := range want {
+		if !intensities[i].start.Equal(want[i].start) || intensities[i].factor != want[i].factor {
+			t.Errorf("row %d: %s %g, want %s %g", i, intensities[i].start, intensities[i].factor, want[i].start, want[i].factor)
+		}
+	}
+}
+
+func TestReadCSVInvalid(t *testing.T) {
+	tests := []struct {
+		name, csv string
+	}{
+		{"bad factor after the header", "timestamp,factor\n2026-07-01,high\n"},
+		{"bad timestamp", "07/01/2026,0.4\n"},
+		{"missing factor", "2026-07-01\n"},
+	}
+	for _, test := range tests {
+		if _, err := readCSV(strings.NewReader(test.csv), time.UTC); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestFactor(t *testing.T) {
+	hourly := make([]float64, 24)
+	for hour := range hourly {
+		hourly[hour] = float64(hour) / 100
+	}
+	intensities := []intensity{
+		{time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC), 0.40},
+		{time.Date(2026, 7, 2, 0, 0, 0, 0, time.UTC), 0.30},
+	}
+	before := time.Date(2026, 6, 30, 15, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		t        time.Time
+		want     float64
+		ok       bool
+	}{
+		{"static", Schedule{static: 0.4}, before, 0.4, true},
+		{"hourly over static", Schedule{static: 0.4, hourly: hourly}, before, 0.15, true},
+		{"first row", Schedule{intensities: intensities}, intensities[0].start, 0.40, true},
+		{"until the next row", Schedule{intensities: intensities}, intensities[1].start.Add(-time.Second), 0.40, true},
+		{"last row", Schedule{intensities: intensities}, time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), 0.30, true},
+		{"before the file, hourly", Schedule{hourly: hourly, intensities: intensities}, before, 0.15, true},
+		{"before the file, static", Schedule{static: 0.5, intensities: intensities}, before, 0.5, true},
+		{"before the file only", Schedule{intensities: intensities}, before, 0, false},
+	}
+	for _, test := range tests {
+		test.schedule.location = time.UTC
+		got, ok := test.schedule.Factor(test.t)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%s: got %g %v, want %g %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestMonthly(t *testing.T) {
+	schedule := &Schedule{
+		location: time.UTC,
+		intensities: []intensity{
+			{time.Date(2026, 7, 31, 23, 0, 0, 0, time.UTC), 0.5},
+		},
+	}
+	rows := []store.TrendRow{
+		{Time: time.Date(2026, 7, 31, 22, 0, 0, 0, time.UTC), Consumption: 9, Production: 0}, // Before the file
+		{Time: time.Date(2026, 7, 31, 23, 0, 0, 0, time.UTC), Consumption: 2, Production: 0},
+		{Time: time.Date(2026, 8, 1, 12, 0, 0, 0, time.UTC), Consumption: 3, Production: 1},
+	}
+
+	months, skipped := schedule.Monthly(rows)
+	if skipped != 1 {
+		t.Errorf("skipped %d rows, want 1", skipped)
+	}
+	if len(months) != 2 {
+		t.Fatalf("got %d months, want 2", len(months))
+	}
+	if july := months[0]; july.Consumption != 2 || july.CO2 != 1 {
+		t.Errorf("july %g kWh %g kg, want 2 kWh 1 kg", july.Consumption, july.CO2)
+	}
+	if august := months[1]; august.GridImport != 2 || august.CO2 != 1.5 || august.CO2Import != 1 {
+		t.Errorf("august import %g kWh, %g kg, import %g kg", august.GridImport, august.CO2, august.CO2Import)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if schedule, err := New(config.CarbonConfig{}, time.UTC); schedule != nil || err != nil {
+		t.Errorf("empty config: %v %v, want nil", schedule, err)
+	}
+	if _, err := New(config.CarbonConfig{Hourly: []float64{0.1, 0.2}}, time.UTC); err == nil {
+		t.Error("short hourly profile: expected an error")
+	}
+}
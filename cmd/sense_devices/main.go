@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/logging"
+	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/sqlite"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/go-homedir"
+)
+
+// One device in the JSON inventory file
+type deviceInfo struct {
+	ID    string            `json:"id"`
+	Name  string            `json:"name"`
+	Type  string            `json:"type"`
+	Make  string            `json:"make,omitempty"`
+	Model string            `json:"model,omitempty"`
+	Icon  string            `json:"icon,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty"`
+}
+
+func main() {
+	// Command Line Options
+	var opts struct {
+		ConfigFile string          `short:"c" long:"config" description:"Config file path" default:"~/.sense_logger.toml"`
+		InfluxDB   bool            `long:"influxdb" description:"Sync the devices to the InfluxDB Inventory measurement"`
+		SQLite     bool            `long:"sqlite" description:"Sync the devices to the SQLite devices table"`
+		JSON       string          `long:"json" description:"Write the devices to a JSON file"`
+		Quiet      bool            `short:"q" long:"quiet" description:"Don't list the devices"`
+		Logging    logging.Options `group:"Logging Options"`
+	}
+	_, err := flags.Parse(&opts)
+	if err != nil {
+		// go-flags has already printed the error or help message
+		if flags.WroteHelp(err) {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+
+	logger, err := opts.Logging.New()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Load Config
+	cfg, err := config.LoadConfig(opts.ConfigFile, true)
+	fatalOnErr(logger, "Loading config", err)
+	if opts.InfluxDB && cfg.InfluxDB.Inventory.Measurement == "" {
+		fatalOnErr(logger, "Loading config", fmt.Errorf("no InfluxDB Inventory measurement configured"))
+	}
+	if opts.SQLite && cfg.SQLite.File == "" {
+		fatalOnErr(logger, "Loading config", fmt.Errorf("no SQLite file configured"))
+	}
+
+	devices, err := sense.GetDevices(cfg.Sense.Credentials, logger)
+	fatalOnErr(logger, "Getting devices", err)
+	now := time.Now()
+
+	if !opts.Quiet {
+		printDevices(devices)
+	}
+	if opts.InfluxDB {
+		fatalOnErr(logger, "Writing devices to InfluxDB", writeInfluxDB(cfg, devices, now))
+	}
+	if opts.SQLite {
+		fatalOnErr(logger, "Writing devices to SQLite", writeSQLite(cfg, devices, now))
+	}
+	if opts.JSON != "" {
+		fatalOnErr(logger, "Writing devices to JSON", writeJSON(opts.JSON, devices))
+	}
+
+	logger.Info("Devices listed", "devices", len(devices), "influxdb", opts.InfluxDB, "sqlite", opts.SQLite, "json", opts.JSON)
+}
+
+// List the devices with their string tags
+func printDevices(devices []sense.Device) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tName\tType\tMake\tModel\tTags")
+	for _, device := range devices {
+		tags := device.StringTags()
+		names := make([]string, 0, len(tags))
+		for name := range tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		pairs := make([]string, len(names))
+		for i, name := range names {
+			pairs[i] = name + "=" + tags[name]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", device.ID, device.Name, device.Type(),
+			device.Make, device.Model, strings.Join(pairs, ","))
+	}
+	w.Flush()
+}
+
+// One point per device, keyed by the time of the sync so the measurement keeps a history of
+// names.  Join on device_id with the latest point to name devices.
+func writeInfluxDB(cfg *config.Config, devices []sense.Device, now time.Time) error {
+	client := influxdb2.NewClientWithOptions(
+		cfg.InfluxDB.Server.URL,
+		cfg.InfluxDB.Server.AuthToken(),
+		influxdb2.DefaultOptions().SetPrecision(time.Second))
+	defer client.Close()
+
+	writeAPI := client.WriteAPIBlocking(
+		cfg.InfluxDB.Server.OrgName(),
+		cfg.InfluxDB.Inventory.BucketName(cfg.InfluxDB.Server))
+
+	batch := make([]*write.Point, 0, len(devices))
+	for _, device := range devices {
+		tags := map[string]string{
+			"monitorID": fmt.Sprintf("%d", cfg.Sense.Credentials.MonitorID),
+			"device_id": device.ID,
+		}
+		fields := map[string]interface{}{
+			"name":  device.Name,
+			"type":  device.Type(),
+			"make":  device.Make,
+			"model": device.Model,
+			"icon":  device.Icon,
+		}
+		batch = append(batch, write.NewPoint(cfg.InfluxDB.Inventory.Measurement, tags, fields, now))
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return writeAPI.WritePoint(context.Background(), batch...)
+}
+
+// Replace the monitor's devices in the SQLite devices table
+func writeSQLite(cfg *config.Config, devices []sense.Device, now time.Time) error {
+	filename, err := homedir.Expand(cfg.SQLite.File)
+	if err != nil {
+		return err
+	}
+	db, err := sqlite.Open(filename, cfg.Sense.Credentials.MonitorID)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.WriteDevices(context.Background(), cfg.SQLite.DevicesTableName(), devices, now)
+}
+
+// Write the devices to a JSON file
+func writeJSON(filename string, devices []sense.Device) error {
+	filename, err := homedir.Expand(filename)
+	if err != nil {
+		return err
+	}
+
+	infos := make([]deviceInfo, len(devices))
+	for i, device := range devices {
+		infos[i] = deviceInfo{
+			ID:    device.ID,
+			Name:  device.Name,
+			Type:  device.Type(),
+			Make:  device.Make,
+			Model: device.Model,
+			Icon:  device.Icon,
+			Tags:  device.StringTags(),
+		}
+	}
+	data, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+func fatalOnErr(logger *slog.Logger, msg string, err error) {
+	if err != nil {
+		logging.Fatal(logger, msg, err)
+	}
+}
@@ -3,13 +3,14 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"strings"
 	"syscall"
 
 	"github.com/david-lutz/sense_logger/config"
 	"github.com/david-lutz/sense_logger/credentials"
+	"github.com/david-lutz/sense_logger/logging"
 	"github.com/jessevdk/go-flags"
 	"github.com/mitchellh/go-homedir"
 	"golang.org/x/crypto/ssh/terminal"
@@ -17,47 +18,60 @@ import (
 
 func main() {
 	var opts struct {
-		ConfigFile string `short:"c" long:"config" description:"Config file path" default:"~/.sense_logger.toml"`
-		Email      string `long:"email" description:"Sense Account E-mail Address" env:"SENSE_EMAIL"`
-		Password   string `long:"password" description:"Sense Account Password" env:"SENSE_PASSWORD"`
+		ConfigFile string          `short:"c" long:"config" description:"Config file path" default:"~/.sense_logger.toml"`
+		Email      string          `long:"email" description:"Sense Account E-mail Address" env:"SENSE_EMAIL"`
+		Password   string          `long:"password" description:"Sense Account Password" env:"SENSE_PASSWORD"`
+		Logging    logging.Options `group:"Logging Options"`
 	}
 
 	_, err := flags.Parse(&opts)
-	fatalOnErr(err)
+	if err != nil {
+		// go-flags has already printed the error or help message
+		if flags.WroteHelp(err) {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+
+	logger, err := opts.Logging.New()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	cfg, err := config.LoadConfig(opts.ConfigFile, false)
-	fatalOnErr(err)
+	fatalOnErr(logger, "Loading config", err)
 
 	if opts.Email == "" {
 		reader := bufio.NewReader(os.Stdin)
 		fmt.Print("Enter Sense E-mail: ")
 		email, err := reader.ReadString('\n')
-		fatalOnErr(err)
+		fatalOnErr(logger, "Reading e-mail", err)
 		opts.Email = strings.TrimSpace(email)
 	}
 
 	if opts.Password == "" {
 		fmt.Print("Enter Sense Password: ")
 		bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
-		fatalOnErr(err)
+		fatalOnErr(logger, "Reading password", err)
 		fmt.Println() // ReadPassword doesn't echo the final \n of the password, fake it here
 		opts.Password = strings.TrimSpace(string(bytePassword))
 	}
 
-	creds, err := credentials.FetchCredentials(opts.Email, opts.Password)
-	fatalOnErr(err)
+	creds, err := credentials.FetchCredentials(opts.Email, opts.Password, logger)
+	fatalOnErr(logger, "Fetching credentials", err)
 
 	credFile, err := homedir.Expand(cfg.Sense.CredentialFile)
-	fatalOnErr(err)
-	err = credentials.WriteCreds(creds, credFile)
-	fatalOnErr(err)
+	fatalOnErr(logger, "Expanding credential file", err)
+	err = credentials.WriteCreds(creds, credFile, logger)
+	fatalOnErr(logger, "Writing credentials", err)
 
 	fmt.Println("Successfully retrieved Sense API Credentials")
 	fmt.Println("Credentials stored in:", credFile)
 }
 
-func fatalOnErr(err error) {
+func fatalOnErr(logger *slog.Logger, msg string, err error) {
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logger, msg, err)
 	}
 }
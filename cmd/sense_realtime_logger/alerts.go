@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/david-lutz/sense_logger/alert"
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/notify"
+	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/solar"
+)
+
+// Publisher implementation, checks realtime data against the threshold alert rules
+type alertPublisher struct {
+	rules     []*alert.Rule
+	notifiers []notify.Notifier
+	location  *time.Location
+	cooker    *solar.Cooker
+	status    *sinkStatus
+	logger    *slog.Logger
+}
+
+// Setup the realtime alert rules and notifiers
+func alertConnect(cfg *config.Config, cooker *solar.Cooker, status *sinkStatus, logger *slog.Logger) (publisher, error) {
+	location, err := time.LoadLocation(cfg.Sense.Credentials.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := alert.Rules(cfg.Alerts, alert.SourceRealTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return &alertPublisher{
+		rules:     rules,
+		notifiers: alert.Notifiers(cfg.Alerts),
+		location:  location,
+		cooker:    cooker,
+		status:    status,
+		logger:    logger.With("publisher", "alerts"),
+	}, nil
+}
+
+// Close publisher
+func (p *alertPublisher) Close() {}
+
+// Publish checks a realtime data point against every rule, time of day windows use the
+// monitor's time zone
+func (p *alertPublisher) Publish(realtime sense.RealTime) {
+	// Same production cooking as the raw realtime data
+	realtime.Production = p.cooker.Cook(realtime.Timestamp, 0, realtime.Production)
+
+	fields := alert.RealTimeFields(realtime)
+	t := realtime.Timestamp.In(p.location)
+	for _, rule := range p.rules {
+		event := rule.Check(t, fields)
+		if event == nil {
+			continue
+		}
+
+		p.status.publish()
+		delivered, err := alert.Notify(*event, p.notifiers, p.logger)
+		if err != nil {
+			p.status.failure(err)
+		}
+		if delivered > 0 {
+			p.status.success(1)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/david-lutz/sense_logger/credentials"
+	"github.com/david-lutz/sense_logger/sense"
+)
+
+// Defaults for the REST API
+const (
+	defaultTrendCacheTTL = 5 * time.Minute
+	streamBufferSize     = 16 // Messages buffered per Server-Sent Events client
+)
+
+// Publisher that keeps the latest realtime message and streams messages to Server-Sent Events
+// clients.  Clients that can't keep up miss messages rather than stalling the stream.
+type apiPublisher struct {
+	status *sinkStatus
+
+	mu          sync.Mutex
+	latest      []byte
+	subscribers map[chan []byte]struct{}
+	closed      bool
+}
+
+func newAPIPublisher(status *sinkStatus) *apiPublisher {
+	return &apiPublisher{
+		status:      status,
+		subscribers: make(map[chan []byte]struct{}),
+	}
+}
+
+// Publish remembers the message and hands it to every stream client
+func (a *apiPublisher) Publish(realtime sense.RealTime) {
+	a.status.publish()
+	json, err := realtime.ToJSON()
+	if err != nil {
+		a.status.failure(err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.latest = json
+	for ch := range a.subscribers {
+		select {
+		case ch <- json:
+		default:
+		}
+	}
+	a.status.success(1)
+}
+
+// Close ends all the streams
+func (a *apiPublisher) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	a.closed = true
+	for ch := range a.subscribers {
+		close(ch)
+		delete(a.subscribers, ch)
+	}
+}
+
+func (a *apiPublisher) subscribe() (chan []byte, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, false
+	}
+	ch := make(chan []byte, streamBufferSize)
+	a.subscribers[ch] = struct{}{}
+	return ch, true
+}
+
+func (a *apiPublisher) unsubscribe(ch chan []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.subscribers[ch]; ok {
+		close(ch)
+		delete(a.subscribers, ch)
+	}
+}
+
+// Add the /realtime/latest and /realtime/stream handlers to mux
+func (a *apiPublisher) routes(mux *http.ServeMux) {
+	mux.HandleFunc("/realtime/latest", a.serveLatest)
+	mux.HandleFunc("/realtime/stream", a.serveStream)
+}
+
+func (a *apiPublisher) serveLatest(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	latest := a.latest
+	a.mu.Unlock()
+
+	if latest == nil {
+		writeJSON(w, http.StatusServiceUnavailable, apiError{"no realtime data yet"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(latest)
+	w.Write([]byte{'\n'})
+}
+
+// Server-Sent Events stream, one "data:" event per realtime message
+func (a *apiPublisher) serveStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, apiError{"streaming unsupported"})
+		return
+	}
+	ch, ok := a.subscribe()
+	if !ok {
+		writeJSON(w, http.StatusServiceUnavailable, apiError{"shutting down"})
+		return
+	}
+	defer a.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case json, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", json); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// JSON error body
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// JSON view of a TrendRecord
+type trendRecordJSON struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Consumption float64   `json:"consumption"`
+	Production  float64   `json:"production"`
+}
+
+// JSON response for /trends
+type trendResponse struct {
+	Scale   string            `json:"scale"`
+	Start   time.Time         `json:"start"`
+	Fetched time.Time         `json:"fetched"`
+	Records []trendRecordJSON `json:"records"`
+}
+
+// Proxies GetTrendData, caching responses so repeated requests don't go back to Sense
+type trendCache struct {
+	creds    credentials.Credentials
+	location *time.Location
+	ttl      time.Duration
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	entries map[string]trendResponse
+}
+
+func newTrendCache(creds credentials.Credentials, ttl time.Duration, logger *slog.Logger) (*trendCache, error) {
+	location, err := time.LoadLocation(creds.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		ttl = defaultTrendCacheTTL
+	}
+	return &trendCache{
+		creds:    creds,
+		location: location,
+		ttl:      ttl,
+		logger:   logger,
+		entries:  make(map[string]trendResponse),
+	}, nil
+}
+
+// Add the /trends handler to mux
+func (c *trendCache) routes(mux *http.ServeMux) {
+	mux.HandleFunc("/trends", c.serveTrends)
+}
+
+// GET /trends?scale=DAY&start=2024-01-31, start is a date in the monitor's time zone or an
+// RFC3339 time and defaults to now
+func (c *trendCache) serveTrends(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	scale, err := sense.ParseScale(query.Get("scale"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+	start := time.Now().In(c.location)
+	if str := query.Get("start"); str != "" {
+		if start, err = time.ParseInLocation("2006-01-02", str, c.location); err != nil {
+			if start, err = time.Parse(time.RFC3339, str); err != nil {
+				writeJSON(w, http.StatusBadRequest, apiError{fmt.Sprintf("invalid start: %s", str)})
+				return
+			}
+		}
+	}
+
+	// Requests for the same period share a cache entry
+	res, err := c.get(scale, scale.Period(start, c.location))
+	if err != nil {
+		c.logger.Error("Fetching trend data", "scale", scale, "start", start, "err", err)
+		writeJSON(w, http.StatusBadGateway, apiError{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Return the cached response or fetch it from Sense
+func (c *trendCache) get(scale sense.Scale, start time.Time) (trendResponse, error) {
+	key := fmt.Sprintf("%s/%d", scale, start.Unix())
+	now := time.Now()
+
+	c.mu.Lock()
+	res, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Sub(res.Fetched) < c.ttl {
+		return res, nil
+	}
+
+	records, err := sense.GetTrendData(c.creds, scale, start.UTC(), c.logger)
+	if err != nil {
+		return trendResponse{}, err
+	}
+	res = trendResponse{
+		Scale:   scale.String(),
+		Start:   start,
+		Fetched: now,
+		Records: make([]trendRecordJSON, len(records)),
+	}
+	for i, record := range records {
+		res.Records[i] = trendRecordJSON{
+			Timestamp:   record.Timestamp,
+			Consumption: record.Consumption,
+			Production:  record.Production,
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Drop expired entries so the cache doesn't grow forever
+	for k, entry := range c.entries {
+		if now.Sub(entry.Fetched) >= c.ttl {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = res
+	return res, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/sense"
+	"github.com/gorilla/websocket"
+)
+
+// Default broadcast options
+const (
+	defaultClientBuffer = 32
+	defaultWriteTimeout = 5 * time.Second
+)
+
+// One websocket frame queued for a client
+type broadcastFrame struct {
+	messageType int
+	data        []byte
+}
+
+// A local websocket client, frames are written by its own goroutine
+type broadcastClient struct {
+	conn *websocket.Conn
+	send chan broadcastFrame
+	addr string
+}
+
+// Re-broadcasts the realtime feed to local websocket clients, so Sense only sees our one
+// connection.  Each client has a bounded buffer, clients that fall behind or stop accepting
+// writes are disconnected rather than holding up the others.
+type broadcaster struct {
+	raw          bool
+	bufferSize   int
+	writeTimeout time.Duration
+	upgrader     websocket.Upgrader
+	status       *sinkStatus
+	logger       *slog.Logger
+
+	mu      sync.Mutex
+	clients map[*broadcastClient]struct{}
+	closed  bool
+}
+
+func newBroadcaster(cfg config.BroadcastConfig, status *sinkStatus, logger *slog.Logger) *broadcaster {
+	b := &broadcaster{
+		raw:          cfg.Raw,
+		bufferSize:   cfg.ClientBuffer,
+		writeTimeout: cfg.WriteTimeout,
+		status:       status,
+		logger:       logger,
+		clients:      make(map[*broadcastClient]struct{}),
+		upgrader: websocket.Upgrader{
+			// Dashboards are served from elsewhere on the LAN
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+	if b.bufferSize <= 0 {
+		b.bufferSize = defaultClientBuffer
+	}
+	if b.writeTimeout <= 0 {
+		b.writeTimeout = defaultWriteTimeout
+	}
+	return b
+}
+
+// Publish sends a parsed realtime message to every client, unless we are sending raw frames
+func (b *broadcaster) Publish(realtime sense.RealTime) {
+	if b.raw {
+		return
+	}
+	b.status.publish()
+	json, err := realtime.ToJSON()
+	if err != nil {
+		b.status.failure(err)
+		return
+	}
+	b.broadcast(broadcastFrame{websocket.TextMessage, json})
+}
+
+// Frame sends a raw Sense frame to every client, if we are sending raw frames
+func (b *broadcaster) Frame(messageType int, message []byte) {
+	if !b.raw {
+		return
+	}
+	b.status.publish()
+	b.broadcast(broadcastFrame{messageType, message})
+}
+
+// Queue the frame for every client, disconnecting any whose buffer is full
+func (b *broadcaster) broadcast(frame broadcastFrame) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		select {
+		case c.send <- frame:
+		default:
+			b.logger.Warn("Broadcast client too slow, disconnecting", "client", c.addr)
+			b.removeLocked(c)
+		}
+	}
+	b.status.success(1)
+}
+
+// Close disconnects every client
+func (b *broadcaster) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for c := range b.clients {
+		b.removeLocked(c)
+	}
+}
+
+// Upgrade the request to a websocket and add the client
+func (b *broadcaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an error
+		b.logger.Debug("Broadcast upgrade", "client", r.RemoteAddr, "err", err)
+		return
+	}
+
+	c := &broadcastClient{
+		conn: conn,
+		send: make(chan broadcastFrame, b.bufferSize),
+		addr: r.RemoteAddr,
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		conn.Close()
+		return
+	}
+	b.clients[c] = struct{}{}
+	b.mu.Unlock()
+	b.logger.Info("Broadcast client connected", "client", c.addr)
+
+	go b.writeLoop(c)
+	go b.readLoop(c)
+}
+
+// Write queued frames until the client is removed, then say goodbye
+func (b *broadcaster) writeLoop(c *broadcastClient) {
+	defer c.conn.Close()
+	for frame := range c.send {
+		c.conn.SetWriteDeadline(time.Now().Add(b.writeTimeout))
+		if err := c.conn.WriteMessage(frame.messageType, frame.data); err != nil {
+			b.logger.Warn("Broadcast write, disconnecting", "client", c.addr, "err", err)
+			b.remove(c)
+			// Drain until remove closes the channel
+			for range c.send {
+			}
+			return
+		}
+	}
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+		time.Now().Add(time.Second))
+}
+
+// Clients don't send us anything, but reading handles pings and notices disconnects
+func (b *broadcaster) readLoop(c *broadcastClient) {
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			b.logger.Info("Broadcast client disconnected", "client", c.addr)
+			b.remove(c)
+			return
+		}
+	}
+}
+
+func (b *broadcaster) remove(c *broadcastClient) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeLocked(c)
+}
+
+// Remove the client and stop its writer, the caller holds b.mu
+func (b *broadcaster) removeLocked(c *broadcastClient) {
+	if _, ok := b.clients[c]; ok {
+		delete(b.clients, c)
+		close(c.send)
+	}
+}
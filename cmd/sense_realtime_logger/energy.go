@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/solar"
+	"golang.org/x/time/rate"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Default energy integration options
+const (
+	defaultEnergyMaxGap   = 10 * time.Second
+	defaultEnergyInterval = 10 * time.Second
+)
+
+// Publisher implementation, integrates realtime power into running energy totals
+type energyPublisher struct {
+	integrator  *sense.EnergyIntegrator
+	client      influxdb2.Client
+	writeAPI    api.WriteAPI
+	measurement string
+	monitorID   int64
+	cooker      *solar.Cooker
+	interval    time.Duration
+	lastPublish time.Time
+	mqtt        *mqttPublisher
+	topic       string
+	status      *sinkStatus
+	logger      *slog.Logger
+}
+
+// Setup the energy integrator and an InfluxDB connection for writing the totals
+func energyConnect(cfg *config.Config, cooker *solar.Cooker, mqtt *mqttPublisher, status *sinkStatus, logger *slog.Logger) (publisher, error) {
+	location, err := time.LoadLocation(cfg.Sense.Credentials.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	maxGap := cfg.Energy.MaxGap
+	if maxGap <= 0 {
+		maxGap = defaultEnergyMaxGap
+	}
+	interval := cfg.Energy.Interval
+	if interval <= 0 {
+		interval = defaultEnergyInterval
+	}
+
+	client := influxdb2.NewClientWithOptions(
+		cfg.InfluxDB.Server.URL,
+		cfg.InfluxDB.Server.AuthToken(),
+		influxdb2.DefaultOptions().
+			SetPrecision(time.Second). // Totals are keyed by period start
+			SetHTTPClient(influxDBHTTPClient(status)))
+
+	writeAPI := client.WriteAPI(cfg.InfluxDB.Server.OrgName(), cfg.InfluxDB.Energy.BucketName(cfg.InfluxDB.Server))
+
+	// Limit how fast we can spam the log
+	limiter := rate.NewLimiter(rate.Every(30*time.Second), 10)
+	logger = logger.With("publisher", "energy")
+	go influxDBErrorLogger(writeAPI.Errors(), limiter, status, logger)
+
+	return &energyPublisher{
+		integrator:  sense.NewEnergyIntegrator(location, maxGap),
+		client:      client,
+		writeAPI:    writeAPI,
+		measurement: cfg.InfluxDB.Energy.Measurement,
+		monitorID:   cfg.Sense.Credentials.MonitorID,
+		cooker:      cooker,
+		interval:    interval,
+		mqtt:        mqtt,
+		topic:       cfg.Energy.Topic,
+		status:      status,
+		logger:      logger,
+	}, nil
+}
+
+// Close publisher, writing out the partial totals we have so far
+func (p *energyPublisher) Close() {
+	p.publishTotals(p.integrator.Totals())
+	p.writeAPI.Flush()
+	p.client.Close()
+}
+
+// Publish integrates a Realtime data point, publishing completed periods immediately and
+// running totals at most once per interval
+func (p *energyPublisher) Publish(realtime sense.RealTime) {
+	// Same production cooking as the raw realtime data
+	realtime.Production = p.cooker.Cook(realtime.Timestamp, 0, realtime.Production)
+
+	completed := p.integrator.Add(realtime)
+	if len(completed) > 0 {
+		p.publishTotals(completed)
+	}
+
+	if realtime.Timestamp.Sub(p.lastPublish) >= p.interval {
+		p.publishTotals(p.integrator.Totals())
+		p.lastPublish = realtime.Timestamp
+	}
+}
+
+// Write totals to InfluxDB and MQTT.  Points are timestamped with the period start, so each
+// update overwrites the previous running total for that period.
+func (p *energyPublisher) publishTotals(totals []sense.EnergyTotals) {
+	for _, total := range totals {
+		tags := map[string]string{
+			"monitorID": fmt.Sprintf("%d", p.monitorID),
+			"period":    total.Period.String(),
+		}
+
+		solar := total.Solar()
+		fields := map[string]interface{}{
+			"consumption":      total.Consumption,
+			"production":       total.Production,
+			"net":              total.Net,
+			"coverage":         total.CoverageRatio(),
+			"grid_import":      solar.GridImport,
+			"grid_export":      solar.GridExport,
+			"self_consumed":    solar.SelfConsumed,
+			"self_sufficiency": solar.SelfSufficiency(),
+			"self_consumption": solar.SelfConsumption(),
+		}
+
+		point := write.NewPoint(p.measurement, tags, fields, total.Start)
+		p.writeAPI.WritePoint(point)
+		p.status.publish()
+	}
+
+	if p.mqtt != nil && p.topic != "" && len(totals) > 0 {
+		if payload, err := json.Marshal(totals); err == nil {
+			p.mqtt.publishJSON(p.topic, payload)
+		} else if p.mqtt.limiter.Allow() {
+			p.logger.Error("Energy JSON marshal", "err", err)
+		}
+	}
+}
@@ -2,11 +2,12 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/david-lutz/sense_logger/config"
 	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/solar"
 	"golang.org/x/time/rate"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
@@ -20,35 +21,40 @@ type influxDBPublisher struct {
 	writeAPI    api.WriteAPI
 	measurement string
 	monitorID   int64
-	threshold   float64
+	cooker      *solar.Cooker
+	status      *sinkStatus
 }
 
 // Setup connection to InfluxDB database for writing realtime data points
-func influxDBConnect(cfg *config.Config) publisher {
+func influxDBConnect(cfg *config.Config, cooker *solar.Cooker, status *sinkStatus, logger *slog.Logger) publisher {
 	client := influxdb2.NewClientWithOptions(
 		cfg.InfluxDB.Server.URL,
-		cfg.InfluxDB.Server.Token,
-		influxdb2.DefaultOptions().SetPrecision(time.Microsecond)) // Precision in Sense message
+		cfg.InfluxDB.Server.AuthToken(),
+		influxdb2.DefaultOptions().
+			SetPrecision(time.Microsecond). // Precision in Sense message
+			SetHTTPClient(influxDBHTTPClient(status)))
 
-	writeAPI := client.WriteAPI(cfg.InfluxDB.Server.Org, cfg.InfluxDB.RealTime.Bucket)
+	writeAPI := client.WriteAPI(cfg.InfluxDB.Server.OrgName(), cfg.InfluxDB.RealTime.BucketName(cfg.InfluxDB.Server))
 
 	// Limit how fast we can spam the log
 	limiter := rate.NewLimiter(rate.Every(30*time.Second), 10)
-	go influxDBErrorLogger(writeAPI.Errors(), limiter)
+	go influxDBErrorLogger(writeAPI.Errors(), limiter, status, logger.With("publisher", "influxdb"))
 
 	return &influxDBPublisher{
 		client:      client,
 		writeAPI:    writeAPI,
 		measurement: cfg.InfluxDB.RealTime.Measurement,
 		monitorID:   cfg.Sense.Credentials.MonitorID,
-		threshold:   cfg.Sense.ProductionThreshold}
+		cooker:      cooker,
+		status:      status}
 }
 
 // Error logging loop for async InfluxDB writes
-func influxDBErrorLogger(errCh <-chan error, limiter *rate.Limiter) {
+func influxDBErrorLogger(errCh <-chan error, limiter *rate.Limiter, status *sinkStatus, logger *slog.Logger) {
 	for err := range errCh {
+		status.failure(err)
 		if limiter.Allow() {
-			log.Print("Influx WriteAPI:", err)
+			logger.Error("InfluxDB write", "err", err)
 		}
 	}
 }
@@ -61,11 +67,8 @@ func (p *influxDBPublisher) Close() {
 
 // Publish a Realtime data point to InfluxDB
 func (p *influxDBPublisher) Publish(realtime sense.RealTime) {
-	// If the production is below the threshold, set it to zero
-	productionCooked := realtime.Production
-	if productionCooked < p.threshold {
-		productionCooked = 0.0
-	}
+	// Zero production at night and below the threshold
+	productionCooked := p.cooker.Cook(realtime.Timestamp, 0, realtime.Production)
 
 	// Tag with MonitorID
 	tags := map[string]string{
@@ -88,4 +91,5 @@ func (p *influxDBPublisher) Publish(realtime sense.RealTime) {
 
 	point := write.NewPoint(p.measurement, tags, fields, realtime.Timestamp)
 	p.writeAPI.WritePoint(point)
+	p.status.publish()
 }
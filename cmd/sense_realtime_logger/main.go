@@ -1,50 +1,272 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/logging"
 	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/solar"
 	"github.com/jessevdk/go-flags"
 )
 
 type publisher interface {
-	Publish(sense.RealTime) // Publish a realtime message, should not block
+	Publish(sense.RealTime) // Publish a realtime message, should not block (see queuedPublisher)
 	Close()                 // Final shutdown of underlying publisher resources
 }
 
 func main() {
-	log.SetFlags(0)
-
 	// Command Line Options
 	var opts struct {
-		ConfigFile string `short:"c" long:"config" description:"Config file path" default:"~/.sense_logger.toml"`
+		ConfigFile string          `short:"c" long:"config" description:"Config file path" default:"~/.sense_logger.toml"`
+		Record     string          `long:"record" description:"Record raw websocket frames to a JSON lines file (gzipped if it ends in .gz)"`
+		Replay     string          `long:"replay" description:"Replay a recording instead of connecting to Sense"`
+		Speed      float64         `long:"speed" description:"Replay speed relative to the recording, 0 replays as fast as possible" default:"1"`
+		Stdout     bool            `long:"stdout" description:"Print realtime messages to stdout instead of publishing them"`
+		Timeout    time.Duration   `long:"shutdown-timeout" description:"Maximum time to spend flushing publishers on shutdown" default:"10s"`
+		Logging    logging.Options `group:"Logging Options"`
 	}
 	_, err := flags.Parse(&opts)
 	if err != nil {
-		log.Fatal(err)
+		// go-flags has already printed the error or help message
+		if flags.WroteHelp(err) {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+
+	logger, err := opts.Logging.New()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
 	// Load Config
 	cfg, err := config.LoadConfig(opts.ConfigFile, true)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logger, "Loading config", err)
 	}
 
-	// Connect to MQTT Broker
-	mqttPublisher, err := mqttConnect(cfg.MQTT)
-	if err != nil {
-		log.Fatal("mqttConnect():", err)
+	status := newHealthStatus(cfg.Sense.Credentials.Timestamp, cfg.HTTP.MaxMessageAge)
+	d := &dispatcher{status: status}
+	if opts.Stdout {
+		d.publishers = append(d.publishers, &logPublisher{})
+	} else {
+		// Connect to MQTT Broker
+		mqttStatus := status.addSink("mqtt")
+		mqttPublisher, err := mqttConnect(cfg.MQTT, mqttStatus, logger)
+		if err != nil {
+			logging.Fatal(logger, "Connecting to MQTT", err)
+		}
+
+		// Production cooking model, shared by every publisher that writes cooked production
+		location, err := time.LoadLocation(cfg.Sense.Credentials.TimeZone)
+		if err != nil {
+			logging.Fatal(logger, "Loading time zone", err)
+		}
+		cooker, err := solar.NewCooker(cfg, location)
+		if err != nil {
+			logging.Fatal(logger, "Setting up production model", err)
+		}
+
+		// Connect to InfluxDB
+		influxDBStatus := status.addSink("influxdb")
+		influxDBPublisher := influxDBConnect(cfg, cooker, influxDBStatus, logger)
+
+		d.publishers = append(d.publishers,
+			queued(influxDBPublisher, cfg, influxDBStatus, logger),
+			queued(mqttPublisher, cfg, mqttStatus, logger))
+
+		// Learn the production baseline from night time readings
+		if cooker.Learning() {
+			productionStatus := status.addSink("production")
+			productionPublisher := newProductionPublisher(cooker, productionStatus, logger)
+			d.publishers = append(d.publishers, queued(productionPublisher, cfg, productionStatus, logger))
+		}
+
+		// Integrate realtime power into energy totals
+		if cfg.Energy.Enabled {
+			energyStatus := status.addSink("energy")
+			energyPublisher, err := energyConnect(cfg, cooker, mqttPublisher, energyStatus, logger)
+			if err != nil {
+				logging.Fatal(logger, "Setting up energy integration", err)
+			}
+			d.publishers = append(d.publishers, queued(energyPublisher, cfg, energyStatus, logger))
+		}
+
+		// Watch voltage and frequency
+		if len(cfg.PowerQuality.Rules) > 0 {
+			powerQualityStatus := status.addSink("power_quality")
+			powerQualityPublisher, err := powerQualityConnect(cfg, mqttPublisher, powerQualityStatus, logger)
+			if err != nil {
+				logging.Fatal(logger, "Setting up power quality alerts", err)
+			}
+			d.publishers = append(d.publishers, queued(powerQualityPublisher, cfg, powerQualityStatus, logger))
+		}
+
+		// Threshold alerts
+		if len(cfg.Alerts.Rules) > 0 {
+			alertStatus := status.addSink("alerts")
+			alertPublisher, err := alertConnect(cfg, cooker, alertStatus, logger)
+			if err != nil {
+				logging.Fatal(logger, "Setting up alerts", err)
+			}
+			d.publishers = append(d.publishers, queued(alertPublisher, cfg, alertStatus, logger))
+		}
+
+		// Connect to PostgreSQL
+		if cfg.Postgres.URL != "" {
+			postgresStatus := status.addSink("postgres")
+			postgresPublisher, err := postgresConnect(cfg, cooker, postgresStatus, logger)
+			if err != nil {
+				logging.Fatal(logger, "Connecting to PostgreSQL", err)
+			}
+			d.publishers = append(d.publishers, queued(postgresPublisher, cfg, postgresStatus, logger))
+		}
+
+		// Open SQLite database
+		if cfg.SQLite.File != "" {
+			sqliteStatus := status.addSink("sqlite")
+			sqlitePublisher, err := sqliteConnect(cfg, cooker, sqliteStatus, logger)
+			if err != nil {
+				logging.Fatal(logger, "Opening SQLite", err)
+			}
+			d.publishers = append(d.publishers, queued(sqlitePublisher, cfg, sqliteStatus, logger))
+		}
+	}
+
+	// REST API for other tools, served by the HTTP server
+	var api *apiPublisher
+	if cfg.HTTP.API && cfg.HTTP.Listen != "" {
+		apiStatus := status.addSink("api")
+		api = newAPIPublisher(apiStatus)
+		d.publishers = append(d.publishers, queued(api, cfg, apiStatus, logger))
+	}
+
+	// Re-broadcast to local websocket clients, served by the HTTP server
+	var bcast *broadcaster
+	if cfg.Broadcast.Path != "" && cfg.HTTP.Listen != "" {
+		broadcastStatus := status.addSink("broadcast")
+		bcast = newBroadcaster(cfg.Broadcast, broadcastStatus, logger)
+		if cfg.Broadcast.Raw {
+			d.broadcaster = bcast
+		} else {
+			d.publishers = append(d.publishers, queued(bcast, cfg, broadcastStatus, logger))
+		}
+	}
+
+	// Capture raw frames for later replay
+	if opts.Record != "" {
+		d.recorder, err = newRecorder(opts.Record, logger)
+		if err != nil {
+			logging.Fatal(logger, "Creating recording", err)
+		}
+		defer d.recorder.Close()
+	}
+
+	// Health and status endpoints
+	var server *http.Server
+	if cfg.HTTP.Listen != "" {
+		mux := http.NewServeMux()
+		status.routes(mux)
+		if api != nil {
+			trends, err := newTrendCache(cfg.Sense.Credentials, cfg.HTTP.TrendCacheTTL, logger)
+			if err != nil {
+				logging.Fatal(logger, "Setting up trend API", err)
+			}
+			api.routes(mux)
+			trends.routes(mux)
+		}
+		if bcast != nil {
+			mux.Handle(cfg.Broadcast.Path, bcast)
+		}
+		server = httpServe(cfg.HTTP.Listen, mux, logger)
+		if api != nil {
+			// End the event streams, otherwise Shutdown waits for them
+			server.RegisterOnShutdown(api.Close)
+		}
+		if bcast != nil {
+			// Shutdown doesn't track websocket connections, close them ourselves
+			server.RegisterOnShutdown(bcast.Close)
+		}
+	}
+	status.setReady()
+
+	// SIGINT or SIGTERM stops reading, then the publishers are flushed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var replayErr error
+	if opts.Replay != "" {
+		// Replay a recording through the same pipeline
+		if replayErr = replay(ctx, opts.Replay, opts.Speed, d, logger); replayErr != nil {
+			logger.Error("Replaying recording", "err", replayErr)
+		}
+	} else {
+		// WebSocket read loop
+		senseReader(ctx, cfg.Sense.Credentials, d, logger)
 	}
-	defer mqttPublisher.Close()
 
-	// Connect to InfluxDB
-	influxDBPublisher := influxDBConnect(cfg)
-	defer influxDBPublisher.Close()
+	shutdown(opts.Timeout, server, d.publishers, status, logger)
+
+	// Flush what was replayed before failing, so scripted replays can still tell it failed
+	if replayErr != nil {
+		stop()
+		os.Exit(1)
+	}
+}
+
+// Close the HTTP server and publishers, giving up after the timeout, then log what was and
+// wasn't delivered by each publisher
+func shutdown(timeout time.Duration, server *http.Server, publishers []publisher, status *healthStatus, logger *slog.Logger) {
+	logger.Info("Shutting down", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	// WebSocket read loop
-	senseReader(cfg.Sense.Credentials, influxDBPublisher, mqttPublisher)
+	if server != nil {
+		server.Shutdown(ctx)
+	}
+
+	// Close in reverse order, publishers may depend on ones created before them
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := len(publishers) - 1; i >= 0; i-- {
+			publishers[i].Close()
+		}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Warn("Shutdown timed out, some publishers were not flushed")
+	}
+
+	for _, sink := range status.snapshot().Publishers {
+		logger.Info("Publisher summary",
+			"publisher", sink.Name,
+			"published", sink.Published,
+			"delivered", sink.Delivered,
+			"undelivered", sink.Published-sink.Delivered,
+			"dropped", sink.Dropped,
+			"queued", sink.QueueDepth,
+			"errors", sink.Errors)
+	}
+}
+
+// Give a publisher its own queue and worker goroutine
+func queued(p publisher, cfg *config.Config, status *sinkStatus, logger *slog.Logger) publisher {
+	q, err := newQueuedPublisher(p, cfg.Queue.ForSink(status.name), status)
+	if err != nil {
+		logging.Fatal(logger, "Setting up publisher queue", err)
+	}
+	return q
 }
 
 // Debuging Publisher
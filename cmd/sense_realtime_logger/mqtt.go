@@ -2,7 +2,7 @@ package main
 
 import (
 	"crypto/tls"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/david-lutz/sense_logger/config"
@@ -16,13 +16,20 @@ type mqttPublisher struct {
 	client  mqtt.Client
 	topic   string
 	limiter *rate.Limiter
+	status  *sinkStatus
+	logger  *slog.Logger
 }
 
 // Setup MQTT Connect with clean session and auto-reconnect enabled, username and password are optional
-func mqttConnect(mqttCfg config.MQTTConfig) (publisher, error) {
+func mqttConnect(mqttCfg config.MQTTConfig, status *sinkStatus, logger *slog.Logger) (*mqttPublisher, error) {
+	logger = logger.With("publisher", "mqtt")
 	connOpts := mqtt.NewClientOptions().AddBroker(mqttCfg.Broker).SetCleanSession(true).SetAutoReconnect(true)
-	connOpts.SetOnConnectHandler(mqttLogConnection)
-	connOpts.SetConnectionLostHandler(mqttLogDisconnect)
+	connOpts.SetOnConnectHandler(func(client mqtt.Client) {
+		logger.Info("MQTT connected", "broker", mqttCfg.Broker)
+	})
+	connOpts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		logger.Warn("MQTT disconnected", "broker", mqttCfg.Broker, "err", err)
+	})
 	if mqttCfg.Password != "" {
 		connOpts.SetUsername(mqttCfg.Password)
 		if mqttCfg.Password != "" {
@@ -41,19 +48,11 @@ func mqttConnect(mqttCfg config.MQTTConfig) (publisher, error) {
 		client:  client,
 		topic:   mqttCfg.Topic,
 		limiter: rate.NewLimiter(rate.Every(30*time.Second), 10),
+		status:  status,
+		logger:  logger,
 	}, nil
 }
 
-// Log Connections
-func mqttLogConnection(client mqtt.Client) {
-	log.Println("MQTT Connected")
-}
-
-// Log Disconnects
-func mqttLogDisconnect(client mqtt.Client, err error) {
-	log.Println("MQTT Disconnected:", err)
-}
-
 // Close publisher
 func (p *mqttPublisher) Close() {
 	p.client.Disconnect(1000)
@@ -64,18 +63,28 @@ func (p *mqttPublisher) Publish(realtime sense.RealTime) {
 	json, err := realtime.ToJSON()
 	if err != nil {
 		if p.limiter.Allow() {
-			log.Print("MQTT JSON Marshall:", err)
+			p.logger.Error("MQTT JSON marshal", "err", err)
 		}
 	} else {
-		token := p.client.Publish(p.topic, 0, false, json)
+		p.publishJSON(p.topic, json)
+	}
+}
+
+// Publish a JSON payload to an arbitrary topic
+func (p *mqttPublisher) publishJSON(topic string, json []byte) {
+	token := p.client.Publish(topic, 0, false, json)
+	p.status.publish()
 
-		// Async error logging for MQTT Publish
-		go func() {
-			if token.Wait() && token.Error() != nil {
-				if p.limiter.Allow() {
-					log.Print("MQTT Publish:", err)
-				}
+	// Async error logging for MQTT Publish
+	go func() {
+		token.Wait()
+		if token.Error() != nil {
+			p.status.failure(token.Error())
+			if p.limiter.Allow() {
+				p.logger.Error("MQTT publish", "topic", topic, "err", token.Error())
 			}
-		}()
-	}
+		} else {
+			p.status.success(1)
+		}
+	}()
 }
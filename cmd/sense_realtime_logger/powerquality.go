@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/notify"
+	"github.com/david-lutz/sense_logger/sense"
+	"golang.org/x/time/rate"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Default nominal line frequency (Hz)
+const defaultNominalFrequency = 60.0
+
+// Power quality alert states
+const (
+	pqAlert = "alert"
+	pqClear = "clear"
+)
+
+// Where a rule is in its alert cycle
+type pqState int
+
+const (
+	pqNormal   pqState = iota
+	pqPending          // Threshold crossed, waiting for Duration
+	pqActive           // Alert raised
+	pqClearing         // Back past the clear level, waiting for Duration
+)
+
+// A power quality alert being raised or cleared
+type powerQualityEvent struct {
+	Rule      string    `json:"rule"`
+	Type      string    `json:"type"`
+	State     string    `json:"state"`
+	Value     float64   `json:"value"`     // Value that triggered the event
+	Worst     float64   `json:"worst"`     // Furthest past the threshold during the alert
+	Threshold float64   `json:"threshold"` // Volts, or Hz from nominal for frequency rules
+	Started   time.Time `json:"started"`   // When the threshold was first crossed
+	Timestamp time.Time `json:"timestamp"`
+	Duration  float64   `json:"duration,omitempty"` // Seconds, for clear events
+}
+
+// A rule and its alert state
+type powerQualityRule struct {
+	config.PowerQualityRule
+	state   pqState
+	since   time.Time // Start of the pending or clearing state
+	started time.Time // Start of the alert, including the pending duration
+	worst   float64
+}
+
+// Validate a rule and fill in the defaults
+func newPowerQualityRule(ruleCfg config.PowerQualityRule) (*powerQualityRule, error) {
+	switch ruleCfg.Type {
+	case "sag", "swell", "imbalance", "frequency":
+	default:
+		return nil, fmt.Errorf("power quality rule %q: invalid type: %s", ruleCfg.Name, ruleCfg.Type)
+	}
+	if ruleCfg.Leg < 0 || ruleCfg.Leg > 2 {
+		return nil, fmt.Errorf("power quality rule %q: invalid leg: %d", ruleCfg.Name, ruleCfg.Leg)
+	}
+	if ruleCfg.Name == "" {
+		ruleCfg.Name = ruleCfg.Type
+	}
+	if ruleCfg.Clear == 0 {
+		ruleCfg.Clear = ruleCfg.Threshold
+	}
+	if ruleCfg.Nominal == 0 {
+		ruleCfg.Nominal = defaultNominalFrequency
+	}
+	return &powerQualityRule{PowerQualityRule: ruleCfg}, nil
+}
+
+// The value the rule watches, false if the message doesn't carry it
+func (r *powerQualityRule) value(realtime sense.RealTime) (float64, bool) {
+	v1, v2 := realtime.Voltage[0], realtime.Voltage[1]
+	switch r.Type {
+	case "sag", "swell":
+		switch {
+		case r.Leg == 1:
+			return v1, v1 != 0
+		case r.Leg == 2:
+			return v2, v2 != 0
+		case v1 == 0 || v2 == 0:
+			return 0, false
+		case r.Type == "sag":
+			return math.Min(v1, v2), true
+		default:
+			return math.Max(v1, v2), true
+		}
+	case "imbalance":
+		return math.Abs(v1 - v2), v1 != 0 && v2 != 0
+	case "frequency":
+		return realtime.Frequency, realtime.Frequency != 0
+	}
+	return 0, false
+}
+
+// How far the value is in the alerting direction, compared against Threshold and Clear
+func (r *powerQualityRule) level(value float64) float64 {
+	switch r.Type {
+	case "sag":
+		return -value
+	case "frequency":
+		return math.Abs(value - r.Nominal)
+	}
+	return value
+}
+
+func (r *powerQualityRule) limit(threshold float64) float64 {
+	if r.Type == "sag" {
+		return -threshold
+	}
+	return threshold
+}
+
+// Step the rule's state machine, returning an event when an alert is raised or cleared
+func (r *powerQualityRule) check(realtime sense.RealTime) *powerQualityEvent {
+	value, ok := r.value(realtime)
+	if !ok {
+		return nil
+	}
+	t := realtime.Timestamp
+	level := r.level(value)
+	violating := level > r.limit(r.Threshold)
+	cleared := level <= r.limit(r.Clear)
+
+	if r.state != pqNormal && level > r.level(r.worst) {
+		r.worst = value
+	}
+
+	switch r.state {
+	case pqNormal:
+		if violating {
+			r.state, r.since, r.started, r.worst = pqPending, t, t, value
+			return r.check(realtime) // Duration may be zero
+		}
+	case pqPending:
+		if !violating {
+			r.state = pqNormal
+		} else if t.Sub(r.since) >= r.Duration {
+			r.state = pqActive
+			return r.event(pqAlert, value, t)
+		}
+	case pqActive:
+		if cleared {
+			r.state, r.since = pqClearing, t
+			return r.check(realtime)
+		}
+	case pqClearing:
+		if !cleared {
+			r.state = pqActive
+		} else if t.Sub(r.since) >= r.Duration {
+			r.state = pqNormal
+			event := r.event(pqClear, value, t)
+			event.Duration = t.Sub(r.started).Seconds()
+			return event
+		}
+	}
+	return nil
+}
+
+func (r *powerQualityRule) event(state string, value float64, t time.Time) *powerQualityEvent {
+	return &powerQualityEvent{
+		Rule:      r.Name,
+		Type:      r.Type,
+		State:     state,
+		Value:     value,
+		Worst:     r.worst,
+		Threshold: r.Threshold,
+		Started:   r.started,
+		Timestamp: t,
+	}
+}
+
+// Publisher implementation, watches voltage and frequency and sends alerts
+type powerQualityPublisher struct {
+	rules       []*powerQualityRule
+	client      influxdb2.Client
+	writeAPI    api.WriteAPI
+	measurement string
+	monitorID   int64
+	mqtt        *mqttPublisher
+	topic       string
+	webhooks    []string
+	limiter     *rate.Limiter
+	status      *sinkStatus
+	logger      *slog.Logger
+}
+
+// Setup the rules and an InfluxDB connection for recording events
+func powerQualityConnect(cfg *config.Config, mqtt *mqttPublisher, status *sinkStatus, logger *slog.Logger) (publisher, error) {
+	var rules []*powerQualityRule
+	for _, ruleCfg := range cfg.PowerQuality.Rules {
+		rule, err := newPowerQualityRule(ruleCfg)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	client := influxdb2.NewClientWithOptions(
+		cfg.InfluxDB.Server.URL,
+		cfg.InfluxDB.Server.AuthToken(),
+		influxdb2.DefaultOptions().SetHTTPClient(influxDBHTTPClient(status)))
+
+	writeAPI := client.WriteAPI(cfg.InfluxDB.Server.OrgName(), cfg.InfluxDB.PowerQuality.BucketName(cfg.InfluxDB.Server))
+
+	// Limit how fast we can spam the log
+	limiter := rate.NewLimiter(rate.Every(30*time.Second), 10)
+	logger = logger.With("publisher", "power_quality")
+	go influxDBErrorLogger(writeAPI.Errors(), limiter, status, logger)
+
+	return &powerQualityPublisher{
+		rules:       rules,
+		client:      client,
+		writeAPI:    writeAPI,
+		measurement: cfg.InfluxDB.PowerQuality.Measurement,
+		monitorID:   cfg.Sense.Credentials.MonitorID,
+		mqtt:        mqtt,
+		topic:       cfg.PowerQuality.Topic,
+		webhooks:    cfg.PowerQuality.Webhooks,
+		limiter:     limiter,
+		status:      status,
+		logger:      logger,
+	}, nil
+}
+
+// Close publisher
+func (p *powerQualityPublisher) Close() {
+	p.writeAPI.Flush()
+	p.client.Close()
+}
+
+// Publish checks a realtime data point against every rule
+func (p *powerQualityPublisher) Publish(realtime sense.RealTime) {
+	for _, rule := range p.rules {
+		if event := rule.check(realtime); event != nil {
+			p.publishEvent(*event)
+		}
+	}
+}
+
+// Log the event, record it in InfluxDB and send it to MQTT and the webhooks
+func (p *powerQualityPublisher) publishEvent(event powerQualityEvent) {
+	if event.State == pqAlert {
+		p.logger.Warn("Power quality alert", "rule", event.Rule, "type", event.Type,
+			"value", event.Value, "threshold", event.Threshold, "started", event.Started)
+	} else {
+		p.logger.Info("Power quality alert cleared", "rule", event.Rule, "type", event.Type,
+			"worst", event.Worst, "duration", event.Duration)
+	}
+
+	if p.measurement != "" {
+		tags := map[string]string{
+			"monitorID": fmt.Sprintf("%d", p.monitorID),
+			"rule":      event.Rule,
+			"type":      event.Type,
+			"state":     event.State,
+		}
+		fields := map[string]interface{}{
+			"value":     event.Value,
+			"worst":     event.Worst,
+			"threshold": event.Threshold,
+			"duration":  event.Duration,
+		}
+		p.writeAPI.WritePoint(write.NewPoint(p.measurement, tags, fields, event.Timestamp))
+		p.status.publish()
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		if p.limiter.Allow() {
+			p.logger.Error("Power quality JSON marshal", "err", err)
+		}
+		return
+	}
+	if p.mqtt != nil && p.topic != "" {
+		p.mqtt.publishJSON(p.topic, payload)
+	}
+
+	for _, url := range p.webhooks {
+		p.status.publish()
+		ctx, cancel := context.WithTimeout(context.Background(), notify.Timeout)
+		err := notify.Webhook(ctx, url, json.RawMessage(payload))
+		cancel()
+		if err != nil {
+			p.status.failure(err)
+			if p.limiter.Allow() {
+				p.logger.Error("Power quality webhook", "url", url, "err", err)
+			}
+		} else {
+			p.status.success(1)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/sense"
+)
+
+// One reading fed to a rule and the event state expected back ("" for no event)
+type pqStep struct {
+	second    int
+	v1, v2    float64
+	frequency float64
+	want      string
+}
+
+var pqStart = time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+
+func runPowerQuality(t *testing.T, ruleCfg config.PowerQualityRule, steps []pqStep) []*powerQualityEvent {
+	t.Helper()
+	rule, err := newPowerQualityRule(ruleCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []*powerQualityEvent
+	for i, step := range steps {
+		event := rule.check(sense.RealTime{
+			Timestamp: pqStart.Add(time.Duration(step.second) * time.Second),
+			Voltage:   [2]float64{step.v1, step.v2},
+			Frequency: step.frequency,
+		})
+		got := ""
+		if event != nil {
+			got = event.State
+			events = append(events, event)
+		}
+		if got != step.want {
+			t.Errorf("%s step %d (+%ds, %g/%g V, %g Hz): event %q, want %q", rule.Name, i, step.second,
+				step.v1, step.v2, step.frequency, got, step.want)
+		}
+	}
+	return events
+}
+
+func TestPowerQualitySag(t *testing.T) {
+	events := runPowerQuality(t, config.PowerQualityRule{
+		Name: "voltage_sag", Type: "sag", Threshold: 110, Clear: 112, Duration: 5 * time.Second,
+	}, []pqStep{
+		{0, 120, 120, 60, ""},
+		{1, 108, 120, 60, ""},       // Pending, the lower leg sags
+		{3, 109, 120, 60, ""},       // Still pending
+		{6, 120, 105, 60, pqAlert},  // Held for 5s
+		{8, 111, 120, 60, ""},       // Above the threshold but not the clear level, still active
+		{9, 113, 120, 60, ""},       // Clearing
+		{12, 111, 120, 60, ""},      // Back below the clear level, active again
+		{13, 113, 120, 60, ""},      // Clearing again
+		{15, 0, 0, 0, ""},           // No voltage in the message, ignored
+		{18, 113, 120, 60, pqClear}, // Cleared for 5s
+		{19, 108, 120, 60, ""},      // A new sag starts pending
+		{20, 120, 120, 60, ""},      // And recovers before the duration
+		{30, 120, 120, 60, ""},
+	})
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+
+	alert, clear := events[0], events[1]
+	if !alert.Started.Equal(pqStart.Add(time.Second)) || alert.Value != 105 || alert.Worst != 105 {
+		t.Errorf("alert started %s value %g worst %g", alert.Started, alert.Value, alert.Worst)
+	}
+	if !clear.Started.Equal(alert.Started) || clear.Worst != 105 || clear.Value != 113 || clear.Duration != 17 {
+		t.Errorf("clear started %s value %g worst %g duration %g", clear.Started, clear.Value, clear.Worst, clear.Duration)
+	}
+}
+
+func TestPowerQualityFlapping(t *testing.T) {
+	// Crossing back and forth faster than the duration never alerts
+	var steps []pqStep
+	for second := 0; second < 30; second += 2 {
+		steps = append(steps, pqStep{second, 127, 120, 60, ""}, pqStep{second + 1, 123, 120, 60, ""})
+	}
+	runPowerQuality(t, config.PowerQualityRule{
+		Type: "swell", Leg: 1, Threshold: 126, Clear: 124, Duration: 3 * time.Second,
+	}, steps)
+
+	// Once raised, dipping past the clear level for less than the duration doesn't clear it
+	runPowerQuality(t, config.PowerQualityRule{
+		Type: "swell", Leg: 2, Threshold: 126, Clear: 124, Duration: 3 * time.Second,
+	}, []pqStep{
+		{0, 120, 127, 60, ""},
+		{3, 130, 127, 60, pqAlert}, // Leg 1 is ignored
+		{4, 120, 123, 60, ""},
+		{5, 120, 125, 60, ""},
+		{6, 120, 123, 60, ""},
+		{8, 120, 123, 60, ""},
+		{9, 120, 123, 60, pqClear},
+	})
+}
+
+func TestPowerQualityNoDuration(t *testing.T) {
+	runPowerQuality(t, config.PowerQualityRule{
+		Type: "imbalance", Threshold: 6, Clear: 4,
+	}, []pqStep{
+		{0, 120, 120, 60, ""},
+		{1, 124, 117, 60, pqAlert}, // 7V apart
+		{2, 122, 117, 60, ""},      // Inside the hysteresis band
+		{3, 120, 117, 60, pqClear},
+		{4, 0, 117, 60, ""}, // Missing leg
+	})
+
+	runPowerQuality(t, config.PowerQualityRule{
+		Type: "frequency", Threshold: 0.5, Clear: 0.2,
+	}, []pqStep{
+		{0, 120, 120, 60.1, ""},
+		{1, 120, 120, 59.4, pqAlert},
+		{2, 120, 120, 0, ""}, // No frequency in the message
+		{3, 120, 120, 60.3, ""},
+		{4, 120, 120, 59.9, pqClear},
+	})
+}
+
+func TestPowerQualityRuleInvalid(t *testing.T) {
+	for _, ruleCfg := range []config.PowerQualityRule{
+		{Name: "bad type", Type: "spike"},
+		{Name: "bad leg", Type: "sag", Leg: 3},
+	} {
+		if _, err := newPowerQualityRule(ruleCfg); err == nil {
+			t.Errorf("%s: expected an error", ruleCfg.Name)
+		}
+	}
+
+	rule, err := newPowerQualityRule(config.PowerQualityRule{Type: "frequency", Threshold: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Name != "frequency" || rule.Clear != 0.5 || rule.Nominal != defaultNominalFrequency {
+		t.Errorf("defaults: name %q clear %g nominal %g", rule.Name, rule.Clear, rule.Nominal)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/solar"
+)
+
+// How often learned nights are written to the state file
+const productionSaveInterval = 10 * time.Minute
+
+// Publisher implementation, learns the production baseline from night time readings
+type productionPublisher struct {
+	cooker   *solar.Cooker
+	lastSave time.Time
+	baseline float64
+	status   *sinkStatus
+	logger   *slog.Logger
+}
+
+func newProductionPublisher(cooker *solar.Cooker, status *sinkStatus, logger *slog.Logger) *productionPublisher {
+	return &productionPublisher{
+		cooker:   cooker,
+		lastSave: time.Now(),
+		baseline: cooker.Baseline(),
+		status:   status,
+		logger:   logger.With("publisher", "production"),
+	}
+}
+
+// Close publisher, saving what we have learned
+func (p *productionPublisher) Close() {
+	p.save()
+}
+
+// Publish learns from a realtime data point, saving the learned nights now and then
+func (p *productionPublisher) Publish(realtime sense.RealTime) {
+	p.status.publish()
+	p.cooker.Learn(realtime.Timestamp, 0, realtime.Production)
+	p.status.success(1)
+
+	if time.Since(p.lastSave) >= productionSaveInterval {
+		p.save()
+	}
+}
+
+func (p *productionPublisher) save() {
+	p.lastSave = time.Now()
+	if baseline := p.cooker.Baseline(); baseline != p.baseline {
+		p.logger.Info("Production baseline updated", "watts", baseline, "previous", p.baseline)
+		p.baseline = baseline
+	}
+	if err := p.cooker.Save(); err != nil {
+		p.status.failure(err)
+		p.logger.Error("Saving production state", "err", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/sense"
+)
+
+// Default queue options
+const (
+	defaultQueueSize   = 1000
+	defaultQueuePolicy = "drop-oldest"
+)
+
+// What to do when a publisher's queue is full
+type dropPolicy int
+
+const (
+	dropOldest dropPolicy = iota // Discard the oldest queued message to make room
+	dropNewest                   // Discard the incoming message
+	block                        // Wait for room, stalling the websocket reader
+)
+
+func parseDropPolicy(str string) (dropPolicy, error) {
+	switch str {
+	case "", "drop-oldest":
+		return dropOldest, nil
+	case "drop-newest":
+		return dropNewest, nil
+	case "block":
+		return block, nil
+	}
+	return 0, fmt.Errorf("invalid queue policy: %s", str)
+}
+
+// Publisher wrapper that hands messages to the real publisher from its own goroutine, so a
+// slow sink doesn't hold up the websocket reader or the other sinks
+type queuedPublisher struct {
+	inner  publisher
+	queue  chan sense.RealTime
+	policy dropPolicy
+	status *sinkStatus
+	done   chan struct{}
+}
+
+// Wrap a publisher with a bounded queue and worker goroutine
+func newQueuedPublisher(inner publisher, queueCfg config.SinkQueueConfig, status *sinkStatus) (publisher, error) {
+	size := queueCfg.Size
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	policy, err := parseDropPolicy(queueCfg.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &queuedPublisher{
+		inner:  inner,
+		queue:  make(chan sense.RealTime, size),
+		policy: policy,
+		status: status,
+		done:   make(chan struct{}),
+	}
+	status.queueDepth = func() int { return len(q.queue) }
+	status.queueSize = size
+
+	go q.worker()
+	return q, nil
+}
+
+func (q *queuedPublisher) worker() {
+	defer close(q.done)
+	for realtime := range q.queue {
+		q.inner.Publish(realtime)
+	}
+}
+
+// Publish queues a realtime message, applying the drop policy if the queue is full
+func (q *queuedPublisher) Publish(realtime sense.RealTime) {
+	switch q.policy {
+	case block:
+		q.queue <- realtime
+
+	case dropNewest:
+		select {
+		case q.queue <- realtime:
+		default:
+			q.status.dropped.Add(1)
+		}
+
+	case dropOldest:
+		for {
+			select {
+			case q.queue <- realtime:
+				return
+			default:
+			}
+			select {
+			case <-q.queue:
+				q.status.dropped.Add(1)
+			default:
+			}
+		}
+	}
+}
+
+// Close drains the queue, then closes the real publisher
+func (q *queuedPublisher) Close() {
+	close(q.queue)
+	<-q.done
+	q.inner.Close()
+}
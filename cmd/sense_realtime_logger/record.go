@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// How often buffered frames are pushed out to the recording file
+const recordFlushInterval = 5 * time.Second
+
+// Encoding of frames that aren't valid JSON, their data is a base64 JSON string
+const recordBase64 = "base64"
+
+// One raw websocket frame, as stored in a recording (one JSON object per line)
+type recordedFrame struct {
+	Received    time.Time       `json:"received"`
+	MessageType int             `json:"messageType"`
+	Encoding    string          `json:"encoding,omitempty"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// Writes raw websocket frames to a JSON lines file, gzipped if the file name ends in .gz
+type recorder struct {
+	file      *os.File
+	gz        *gzip.Writer
+	writer    *bufio.Writer
+	lastFlush time.Time
+	limiter   *rate.Limiter
+	logger    *slog.Logger
+}
+
+// Create (or truncate) a recording file
+func newRecorder(filename string, logger *slog.Logger) (*recorder, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &recorder{
+		file:      file,
+		lastFlush: time.Now(),
+		limiter:   rate.NewLimiter(rate.Every(30*time.Second), 10),
+		logger:    logger.With("file", filename),
+	}
+	if strings.HasSuffix(filename, ".gz") {
+		r.gz = gzip.NewWriter(file)
+		r.writer = bufio.NewWriter(r.gz)
+	} else {
+		r.writer = bufio.NewWriter(file)
+	}
+	return r, nil
+}
+
+// Record a frame, frames that aren't valid JSON are stored base64 encoded so binary frames
+// round trip exactly
+func (r *recorder) Record(received time.Time, messageType int, message []byte) {
+	frame := recordedFrame{Received: received, MessageType: messageType, Data: json.RawMessage(message)}
+	if !json.Valid(message) {
+		frame.Encoding = recordBase64
+		frame.Data, _ = json.Marshal(message)
+	}
+
+	line, err := json.Marshal(frame)
+	if err == nil {
+		line = append(line, '\n')
+		_, err = r.writer.Write(line)
+	}
+	if err == nil && time.Since(r.lastFlush) >= recordFlushInterval {
+		err = r.flush()
+		r.lastFlush = time.Now()
+	}
+	if err != nil && r.limiter.Allow() {
+		r.logger.Error("Recording frame", "err", err)
+	}
+}
+
+func (r *recorder) flush() error {
+	if err := r.writer.Flush(); err != nil {
+		return err
+	}
+	if r.gz != nil {
+		return r.gz.Flush()
+	}
+	return nil
+}
+
+// Close flushes and closes the recording file
+func (r *recorder) Close() {
+	if err := r.flush(); err != nil {
+		r.logger.Error("Closing recording", "err", err)
+	}
+	if r.gz != nil {
+		if err := r.gz.Close(); err != nil {
+			r.logger.Error("Closing recording", "err", err)
+		}
+	}
+	if err := r.file.Close(); err != nil {
+		r.logger.Error("Closing recording", "err", err)
+	}
+}
+
+// Feed a recording through the dispatcher.  Speed is relative to the original timing between
+// frames, i.e. 1 is real time, 10 is ten times faster, and 0 replays as fast as possible.
+func replay(ctx context.Context, filename string, speed float64, d *dispatcher, logger *slog.Logger) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	decoder := json.NewDecoder(reader)
+	var first time.Time
+	var replayStart time.Time
+	count := 0
+	for {
+		var frame recordedFrame
+		if err := decoder.Decode(&frame); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// Pace the frames relative to the first one
+		if first.IsZero() {
+			first = frame.Received
+			replayStart = time.Now()
+		} else if speed > 0 {
+			due := replayStart.Add(time.Duration(float64(frame.Received.Sub(first)) / speed))
+			timer := time.NewTimer(time.Until(due))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		// Frames that weren't JSON were stored base64 encoded
+		message := []byte(frame.Data)
+		switch frame.Encoding {
+		case "":
+		case recordBase64:
+			if err := json.Unmarshal(frame.Data, &message); err != nil {
+				return fmt.Errorf("decoding frame received %s: %w", frame.Received, err)
+			}
+		default:
+			return fmt.Errorf("unknown encoding %q for frame received %s", frame.Encoding, frame.Received)
+		}
+
+		d.dispatch(frame.Received, frame.MessageType, message)
+		count++
+	}
+
+	logger.Info("Replay finished", "file", filename, "frames", count)
+	return nil
+}
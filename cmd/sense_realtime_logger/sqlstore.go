@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/postgres"
+	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/solar"
+	"github.com/david-lutz/sense_logger/sqlite"
+	"github.com/david-lutz/sense_logger/store"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/time/rate"
+)
+
+// Default SQL store options
+const (
+	defaultSQLBatchSize     = 500
+	defaultSQLFlushInterval = 10 * time.Second
+	sqlWriteTimeout         = 30 * time.Second
+	sqliteRollupInterval    = time.Hour
+)
+
+// Publisher implementation, batches realtime rows for a SQL store (PostgreSQL or SQLite).
+// Writes block, so this publisher relies on its queue to keep the websocket reader moving.
+type sqlPublisher struct {
+	write         func(context.Context, []store.RealTimeRow) error
+	close         func()
+	maintain      func(context.Context) // Optional housekeeping, run every maintainEvery
+	maintainEvery time.Duration
+	lastMaintain  time.Time
+	cooker        *solar.Cooker
+	batchSize     int
+	flushInterval time.Duration
+	batch         []store.RealTimeRow
+	lastFlush     time.Time
+	status        *sinkStatus
+	limiter       *rate.Limiter
+	logger        *slog.Logger
+}
+
+func newSQLPublisher(batchSize int, flushInterval time.Duration, cooker *solar.Cooker, status *sinkStatus, logger *slog.Logger) *sqlPublisher {
+	if batchSize <= 0 {
+		batchSize = defaultSQLBatchSize
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultSQLFlushInterval
+	}
+
+	return &sqlPublisher{
+		cooker:        cooker,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		batch:         make([]store.RealTimeRow, 0, batchSize),
+		lastFlush:     time.Now(),
+		lastMaintain:  time.Now(),
+		status:        status,
+		limiter:       rate.NewLimiter(rate.Every(30*time.Second), 10),
+		logger:        logger.With("publisher", status.name),
+	}
+}
+
+// Connect to PostgreSQL for writing realtime data points, the table is named after the
+// realtime measurement
+func postgresConnect(cfg *config.Config, cooker *solar.Cooker, status *sinkStatus, logger *slog.Logger) (publisher, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlWriteTimeout)
+	defer cancel()
+	db, err := postgres.Connect(ctx, cfg.Postgres.URL, cfg.Sense.Credentials.MonitorID, cfg.Postgres.TimescaleDB)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newSQLPublisher(cfg.Postgres.BatchSize, cfg.Postgres.FlushInterval, cooker, status, logger)
+	table := cfg.InfluxDB.RealTime.Measurement
+	p.write = func(ctx context.Context, rows []store.RealTimeRow) error {
+		return db.WriteRealTime(ctx, table, rows)
+	}
+	p.close = db.Close
+	return p, nil
+}
+
+// Open the SQLite database for writing realtime data points, old rows are rolled up into per
+// minute rows once an hour
+func sqliteConnect(cfg *config.Config, cooker *solar.Cooker, status *sinkStatus, logger *slog.Logger) (publisher, error) {
+	filename, err := homedir.Expand(cfg.SQLite.File)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sqlite.Open(filename, cfg.Sense.Credentials.MonitorID)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newSQLPublisher(cfg.SQLite.BatchSize, cfg.SQLite.FlushInterval, cooker, status, logger)
+	table := cfg.InfluxDB.RealTime.Measurement
+	p.write = func(ctx context.Context, rows []store.RealTimeRow) error {
+		return db.WriteRealTime(ctx, table, rows)
+	}
+	p.close = func() {
+		if err := db.Close(); err != nil {
+			p.logger.Error("SQLite close", "err", err)
+		}
+	}
+	if days := cfg.SQLite.RollupAfterDays; days > 0 {
+		p.maintainEvery = sqliteRollupInterval
+		p.maintain = func(ctx context.Context) {
+			before := time.Now().AddDate(0, 0, -days)
+			count, err := db.Rollup(ctx, table, before)
+			if err != nil {
+				p.logger.Error("SQLite rollup", "err", err)
+				return
+			}
+			p.logger.Info("SQLite rollup", "before", before, "rows", count)
+		}
+		p.maintain(context.Background())
+	}
+	return p, nil
+}
+
+// Close publisher, writing any buffered rows
+func (p *sqlPublisher) Close() {
+	p.flush()
+	p.close()
+}
+
+// Publish buffers a realtime data point, writing the batch when it is full or old enough
+func (p *sqlPublisher) Publish(realtime sense.RealTime) {
+	// Zero production at night and below the threshold
+	productionCooked := p.cooker.Cook(realtime.Timestamp, 0, realtime.Production)
+
+	p.batch = append(p.batch, store.RealTimeRow{
+		Time:                realtime.Timestamp,
+		VoltageA:            realtime.Voltage[0],
+		VoltageB:            realtime.Voltage[1],
+		Frequency:           realtime.Frequency,
+		ConsumptionChannelA: realtime.Channels[0],
+		ConsumptionChannelB: realtime.Channels[1],
+		ProductionChannelA:  realtime.Channels[2],
+		ProductionChannelB:  realtime.Channels[3],
+		Consumption:         realtime.Consumption,
+		Production:          productionCooked,
+		ProductionRaw:       realtime.Production,
+	})
+	p.status.publish()
+
+	if len(p.batch) >= p.batchSize || time.Since(p.lastFlush) >= p.flushInterval {
+		p.flush()
+	}
+
+	if p.maintain != nil && time.Since(p.lastMaintain) >= p.maintainEvery {
+		p.lastMaintain = time.Now()
+		p.maintain(context.Background())
+	}
+}
+
+// Write the buffered rows, on failure the batch is discarded and counted as an error
+func (p *sqlPublisher) flush() {
+	p.lastFlush = time.Now()
+	if len(p.batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sqlWriteTimeout)
+	defer cancel()
+	if err := p.write(ctx, p.batch); err != nil {
+		p.status.failure(err)
+		if p.limiter.Allow() {
+			p.logger.Error("Write", "rows", len(p.batch), "err", err)
+		}
+	} else {
+		p.status.success(int64(len(p.batch)))
+	}
+	p.batch = p.batch[:0]
+}
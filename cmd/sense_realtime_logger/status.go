@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default age of the last realtime message before /healthz reports unhealthy
+const defaultMaxMessageAge = 60 * time.Second
+
+// Delivery counters for one publisher, safe for concurrent use
+type sinkStatus struct {
+	name        string
+	published   atomic.Int64
+	delivered   atomic.Int64
+	errors      atomic.Int64
+	dropped     atomic.Int64
+	lastSuccess atomic.Int64 // Unix nanoseconds
+	queueDepth  func() int
+	queueSize   int
+	mu          sync.Mutex
+	lastError   string
+}
+
+// Count a message handed to the publisher
+func (s *sinkStatus) publish() {
+	s.published.Add(1)
+}
+
+// Count messages the underlying sink has accepted
+func (s *sinkStatus) success(n int64) {
+	s.delivered.Add(n)
+	s.lastSuccess.Store(time.Now().UnixNano())
+}
+
+// Count a failed write
+func (s *sinkStatus) failure(err error) {
+	s.errors.Add(1)
+	s.mu.Lock()
+	s.lastError = err.Error()
+	s.mu.Unlock()
+}
+
+// JSON view of a sinkStatus
+type sinkSnapshot struct {
+	Name        string     `json:"name"`
+	Published   int64      `json:"published"`
+	Delivered   int64      `json:"delivered"`
+	Errors      int64      `json:"errors"`
+	Dropped     int64      `json:"dropped"`
+	QueueDepth  int        `json:"queueDepth"`
+	QueueSize   int        `json:"queueSize"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+func (s *sinkStatus) snapshot() sinkSnapshot {
+	snap := sinkSnapshot{
+		Name:      s.name,
+		Published: s.published.Load(),
+		Delivered: s.delivered.Load(),
+		Errors:    s.errors.Load(),
+		Dropped:   s.dropped.Load(),
+		QueueSize: s.queueSize,
+	}
+	if s.queueDepth != nil {
+		snap.QueueDepth = s.queueDepth()
+	}
+	if ns := s.lastSuccess.Load(); ns != 0 {
+		t := time.Unix(0, ns).UTC()
+		snap.LastSuccess = &t
+	}
+	s.mu.Lock()
+	snap.LastError = s.lastError
+	s.mu.Unlock()
+	return snap
+}
+
+// Overall health of the realtime logger, served by the status HTTP endpoints
+type healthStatus struct {
+	mu          sync.Mutex
+	started     time.Time
+	ready       bool
+	connected   bool
+	connections int64
+	lastMessage time.Time
+	credentials time.Time
+	maxAge      time.Duration
+	sinks       []*sinkStatus
+}
+
+func newHealthStatus(credentials time.Time, maxAge time.Duration) *healthStatus {
+	if maxAge <= 0 {
+		maxAge = defaultMaxMessageAge
+	}
+	return &healthStatus{
+		started:     time.Now(),
+		credentials: credentials,
+		maxAge:      maxAge,
+	}
+}
+
+// Register a publisher for status reporting
+func (h *healthStatus) addSink(name string) *sinkStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := &sinkStatus{name: name}
+	h.sinks = append(h.sinks, s)
+	return s
+}
+
+// Mark startup as finished, publishers are connected and we are about to read from Sense
+func (h *healthStatus) setReady() {
+	h.mu.Lock()
+	h.ready = true
+	h.mu.Unlock()
+}
+
+// Record websocket connects and disconnects
+func (h *healthStatus) setConnected(connected bool) {
+	h.mu.Lock()
+	h.connected = connected
+	if connected {
+		h.connections++
+	}
+	h.mu.Unlock()
+}
+
+// Record the arrival of a websocket message
+func (h *healthStatus) message(received time.Time) {
+	h.mu.Lock()
+	h.lastMessage = received
+	h.mu.Unlock()
+}
+
+// Healthy when the websocket is connected and data is still flowing
+func (h *healthStatus) healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.connected && !h.lastMessage.IsZero() && time.Since(h.lastMessage) < h.maxAge
+}
+
+func (h *healthStatus) isReady() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ready
+}
+
+// JSON view of the healthStatus
+type statusSnapshot struct {
+	Started        time.Time      `json:"started"`
+	Uptime         float64        `json:"uptime"` // Seconds
+	Healthy        bool           `json:"healthy"`
+	Ready          bool           `json:"ready"`
+	Connected      bool           `json:"connected"`
+	LastMessage    *time.Time     `json:"lastMessage,omitempty"`
+	LastMessageAge *float64       `json:"lastMessageAge,omitempty"` // Seconds
+	Reconnects     int64          `json:"reconnects"`
+	Credentials    time.Time      `json:"credentials"`
+	CredentialsAge float64        `json:"credentialsAge"` // Seconds
+	Publishers     []sinkSnapshot `json:"publishers"`
+}
+
+func (h *healthStatus) snapshot() statusSnapshot {
+	healthy := h.healthy()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	snap := statusSnapshot{
+		Started:        h.started.UTC(),
+		Uptime:         now.Sub(h.started).Seconds(),
+		Healthy:        healthy,
+		Ready:          h.ready,
+		Connected:      h.connected,
+		Credentials:    h.credentials,
+		CredentialsAge: now.Sub(h.credentials).Seconds(),
+		Publishers:     make([]sinkSnapshot, 0, len(h.sinks)),
+	}
+	if h.connections > 1 {
+		snap.Reconnects = h.connections - 1
+	}
+	if !h.lastMessage.IsZero() {
+		lastMessage := h.lastMessage.UTC()
+		age := now.Sub(h.lastMessage).Seconds()
+		snap.LastMessage = &lastMessage
+		snap.LastMessageAge = &age
+	}
+	for _, s := range h.sinks {
+		snap.Publishers = append(snap.Publishers, s.snapshot())
+	}
+	return snap
+}
+
+// Add the /healthz, /readyz and /status handlers to mux
+func (h *healthStatus) routes(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeCheck(w, h.healthy())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeCheck(w, h.isReady())
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, h.snapshot())
+	})
+}
+
+func writeCheck(w http.ResponseWriter, ok bool) {
+	if ok {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "ok\n")
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "unavailable\n")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Start the HTTP server in the background
+func httpServe(listen string, mux *http.ServeMux, logger *slog.Logger) *http.Server {
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		logger.Info("HTTP server listening", "addr", listen)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("HTTP server", "err", err)
+		}
+	}()
+	return server
+}
+
+// HTTP transport for the InfluxDB client that counts the points accepted by each write
+type influxDBTransport struct {
+	base   http.RoundTripper
+	status *sinkStatus
+}
+
+func (t *influxDBTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Line protocol is one point per line
+	var points int64
+	if req.Body != nil && strings.HasSuffix(req.URL.Path, "/write") {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		points = int64(bytes.Count(body, []byte{'\n'}))
+		if len(body) > 0 && body[len(body)-1] != '\n' {
+			points++
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err == nil && res.StatusCode/100 == 2 && points > 0 {
+		t.status.success(points)
+	}
+	return res, err
+}
+
+// HTTP client for the InfluxDB client, with the library's default timeout
+func influxDBHTTPClient(status *sinkStatus) *http.Client {
+	return &http.Client{
+		Timeout:   20 * time.Second,
+		Transport: &influxDBTransport{base: http.DefaultTransport, status: status},
+	}
+}
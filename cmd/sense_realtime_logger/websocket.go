@@ -3,7 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/david-lutz/sense_logger/credentials"
@@ -14,62 +14,100 @@ import (
 
 var wsURL = "wss://clientrt.sense.com/monitors/%d/realtimefeed?access_token=%s"
 
+// Routes raw websocket frames to the recorder (and raw broadcaster) and parsed realtime
+// messages to publishers
+type dispatcher struct {
+	recorder    *recorder
+	broadcaster *broadcaster
+	publishers  []publisher
+	status      *healthStatus
+}
+
+// Handle one websocket frame
+func (d *dispatcher) dispatch(received time.Time, messageType int, message []byte) {
+	d.status.message(received)
+	if d.recorder != nil {
+		d.recorder.Record(received, messageType, message)
+	}
+	if d.broadcaster != nil {
+		d.broadcaster.Frame(messageType, message)
+	}
+
+	if messageType == websocket.TextMessage {
+		// Process "realtime_update" messages only
+		if senseMsgType, err := sense.MessageType(message); err == nil && senseMsgType == "realtime_update" {
+			if realtime, err := sense.ParseRealTimeData(message); err == nil {
+				for _, publisher := range d.publishers {
+					publisher.Publish(realtime)
+				}
+			}
+		}
+	}
+}
+
 // Launch a webSocket reader for realtime Sense data.  The Sense website has a tendency to
 // uncerimoniously disconnect every so often, so we catch the disconnects and reconnect.
-func senseReader(creds credentials.Credentials, publishers ...publisher) {
+// Returns once the context is cancelled.
+func senseReader(ctx context.Context, creds credentials.Credentials, d *dispatcher, logger *slog.Logger) {
 	// Rate limiter so we don't reconnect to fast
 	limiter := rate.NewLimiter(rate.Every(30*time.Second), 3)
 
 	for {
 		limiter.Reserve()
-		limiter.Wait(context.Background())
-		webSocketReader(creds, publishers...)
+		if err := limiter.Wait(ctx); err != nil {
+			return
+		}
+		webSocketReader(ctx, creds, d, logger)
 	}
 }
 
 // Connect to the WebSocket endpoint and read until loop finishes (i.e. Sense closes the connection)
-func webSocketReader(creds credentials.Credentials, publishers ...publisher) {
+// or the context is cancelled
+func webSocketReader(ctx context.Context, creds credentials.Credentials, d *dispatcher, logger *slog.Logger) {
 	url := fmt.Sprintf(wsURL, creds.MonitorID, creds.Token)
-	log.Printf("Connecting to %s", url)
+	logger.Info("WebSocket connecting", "monitorID", creds.MonitorID)
 
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
 	if conn != nil {
 		defer conn.Close()
 	}
 	if err != nil {
-		log.Println("WebSocket Dial():", err)
+		logger.Error("WebSocket dial", "err", err)
 		return
 	}
+	d.status.setConnected(true)
+	defer d.status.setConnected(false)
 
 	// Sense WebSocket Read Loop
 	done := make(chan error)
-	go webSocketReadLoop(conn, done, publishers...)
+	go webSocketReadLoop(conn, done, d, logger)
 
-	// Wait for read loop to finish
-	<-done
+	// Wait for read loop to finish, on shutdown say goodbye and close the connection to
+	// unblock ReadMessage
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Info("WebSocket closing")
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(time.Second))
+		conn.Close()
+		<-done
+	}
 }
 
-// Read and parse messages from the websocket, dispatching them to publishers
+// Read messages from the websocket, dispatching them to the recorder and publishers
 // Will close the done channel when the ReadMessage loop exits
-func webSocketReadLoop(wsConn *websocket.Conn, done chan error, publishers ...publisher) {
+func webSocketReadLoop(wsConn *websocket.Conn, done chan error, d *dispatcher, logger *slog.Logger) {
 	defer close(done)
 
 	for {
 		messageType, message, err := wsConn.ReadMessage()
 		if err != nil {
-			log.Println("WebSocket ReadMessage():", err)
+			logger.Warn("WebSocket read", "err", err)
 			return
 		}
 
-		if messageType == 1 {
-			// Process "realtime_update" messages only
-			if senseMsgType, err := sense.MessageType(message); err == nil && senseMsgType == "realtime_update" {
-				if realtime, err := sense.ParseRealTimeData(message); err == nil {
-					for _, publisher := range publishers {
-						publisher.Publish(realtime)
-					}
-				}
-			}
-		}
+		d.dispatch(time.Now(), messageType, message)
 	}
 }
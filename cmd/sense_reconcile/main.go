@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/logging"
+	"github.com/david-lutz/sense_logger/sense"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/jessevdk/go-flags"
+)
+
+// Per minute comparison of realtime integrated energy against the HOUR scale trend data (Wh)
+type minuteEnergy struct {
+	Start               time.Time
+	RealtimeConsumption float64
+	RealtimeProduction  float64
+	TrendConsumption    float64
+	TrendProduction     float64
+	Coverage            float64
+	HaveTrend           bool
+	LowCoverage         bool
+}
+
+func main() {
+	// Command Line Options
+	var opts struct {
+		ConfigFile string          `short:"c" long:"config" description:"Config file path" default:"~/.sense_logger.toml"`
+		Offset     string          `short:"o" long:"offset" description:"Offset from now() for start time" default:"2h"`
+		Start      string          `short:"t" long:"timestamp" description:"Start timestamp in RFC3339 format (overrides offset)"`
+		Window     string          `short:"w" long:"window" description:"Length of the window to reconcile" default:"1h"`
+		MaxGap     string          `long:"max-gap" description:"Longest gap between realtime samples that will be integrated" default:"10s"`
+		Threshold  float64         `long:"coverage-threshold" description:"Flag minutes with realtime coverage below this ratio" default:"0.9"`
+		DryRun     bool            `short:"n" long:"dry-run" description:"Report only, don't write the discrepancy measurement"`
+		Logging    logging.Options `group:"Logging Options"`
+	}
+	_, err := flags.Parse(&opts)
+	if err != nil {
+		// go-flags has already printed the error or help message
+		if flags.WroteHelp(err) {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+
+	logger, err := opts.Logging.New()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	offset, err := time.ParseDuration(opts.Offset)
+	fatalOnErr(logger, "Parsing offset", err)
+	window, err := time.ParseDuration(opts.Window)
+	fatalOnErr(logger, "Parsing window", err)
+	maxGap, err := time.ParseDuration(opts.MaxGap)
+	fatalOnErr(logger, "Parsing max gap", err)
+
+	// Window is aligned to whole minutes to match the HOUR scale trend records
+	start := time.Now().UTC().Add(-1 * offset)
+	if opts.Start != "" {
+		start, err = time.Parse(time.RFC3339, opts.Start)
+		fatalOnErr(logger, "Parsing timestamp", err)
+	}
+	start = start.UTC().Truncate(time.Minute)
+	end := start.Add(window).Truncate(time.Minute)
+
+	// Load Config
+	cfg, err := config.LoadConfig(opts.ConfigFile, true)
+	fatalOnErr(logger, "Loading config", err)
+
+	location, err := time.LoadLocation(cfg.Sense.Credentials.TimeZone)
+	fatalOnErr(logger, "Loading time zone", err)
+
+	client := influxdb2.NewClientWithOptions(
+		cfg.InfluxDB.Server.URL,
+		cfg.InfluxDB.Server.AuthToken(),
+		influxdb2.DefaultOptions().SetPrecision(time.Second))
+	defer client.Close()
+	queryAPI := client.QueryAPI(cfg.InfluxDB.Server.OrgName())
+
+	minutes := make(map[int64]*minuteEnergy)
+	for t := start; t.Before(end); t = t.Add(time.Minute) {
+		minutes[t.Unix()] = &minuteEnergy{Start: t}
+	}
+
+	// Integrate the stored realtime points
+	integrator := sense.NewEnergyIntegrator(location, maxGap)
+	err = queryRealtime(queryAPI, cfg, start, end, func(realtime sense.RealTime) {
+		for _, total := range integrator.Add(realtime) {
+			addRealtime(minutes, total)
+		}
+	})
+	fatalOnErr(logger, "Querying realtime data", err)
+	for _, total := range integrator.Totals() {
+		if !total.End.After(end) {
+			addRealtime(minutes, total)
+		}
+	}
+
+	// Match up with the HOUR scale trend records (kWh per minute)
+	err = queryTrend(queryAPI, cfg, start, end, func(t time.Time, consumption, production float64) {
+		if m, ok := minutes[t.Unix()]; ok {
+			m.TrendConsumption = consumption * 1000.0
+			m.TrendProduction = production * 1000.0
+			m.HaveTrend = true
+		}
+	})
+	fatalOnErr(logger, "Querying trend data", err)
+
+	results := make([]*minuteEnergy, 0, len(minutes))
+	for _, m := range minutes {
+		m.LowCoverage = m.Coverage < opts.Threshold
+		results = append(results, m)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Start.Before(results[j].Start) })
+
+	report(logger, results, location)
+
+	if opts.DryRun {
+		return
+	}
+
+	batch := makePoints(cfg.InfluxDB.Reconcile.Measurement, cfg.Sense.Credentials.MonitorID, results)
+	if len(batch) > 0 {
+		writeAPI := client.WriteAPIBlocking(cfg.InfluxDB.Server.OrgName(), cfg.InfluxDB.Reconcile.BucketName(cfg.InfluxDB.Server))
+		err = writeAPI.WritePoint(context.Background(), batch...)
+		fatalOnErr(logger, "Writing to InfluxDB", err)
+	}
+}
+
+// Accumulate a completed per minute realtime total
+func addRealtime(minutes map[int64]*minuteEnergy, total sense.EnergyTotals) {
+	if total.Period != sense.PerMinute {
+		return
+	}
+	if m, ok := minutes[total.Start.Unix()]; ok {
+		m.RealtimeConsumption = total.Consumption
+		m.RealtimeProduction = total.Production
+		m.Coverage = total.CoverageRatio()
+	}
+}
+
+// Read back realtime points in time order
+func queryRealtime(queryAPI api.QueryAPI, cfg *config.Config, start, end time.Time, fn func(sense.RealTime)) error {
+	query := fmt.Sprintf(`from(bucket: %q)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %q and r.monitorID == "%d")
+  |> filter(fn: (r) => r._field == "consumption" or r._field == "production_raw")
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group()
+  |> sort(columns: ["_time"])`,
+		cfg.InfluxDB.RealTime.BucketName(cfg.InfluxDB.Server),
+		start.Format(time.RFC3339), end.Format(time.RFC3339),
+		cfg.InfluxDB.RealTime.Measurement, cfg.Sense.Credentials.MonitorID)
+
+	result, err := queryAPI.Query(context.Background(), query)
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+
+	for result.Next() {
+		record := result.Record()
+		fn(sense.RealTime{
+			Timestamp:   record.Time(),
+			Consumption: floatValue(record.ValueByKey("consumption")),
+			Production:  floatValue(record.ValueByKey("production_raw")),
+		})
+	}
+	return result.Err()
+}
+
+// Read back HOUR scale trend records
+func queryTrend(queryAPI api.QueryAPI, cfg *config.Config, start, end time.Time, fn func(time.Time, float64, float64)) error {
+	query := fmt.Sprintf(`from(bucket: %q)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %q and r.monitorID == "%d")
+  |> filter(fn: (r) => r._field == "consumption" or r._field == "raw_production")
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`,
+		cfg.InfluxDB.Hour.BucketName(cfg.InfluxDB.Server),
+		start.Format(time.RFC3339), end.Format(time.RFC3339),
+		cfg.InfluxDB.Hour.Measurement, cfg.Sense.Credentials.MonitorID)
+
+	result, err := queryAPI.Query(context.Background(), query)
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+
+	for result.Next() {
+		record := result.Record()
+		fn(record.Time(),
+			floatValue(record.ValueByKey("consumption")),
+			floatValue(record.ValueByKey("raw_production")))
+	}
+	return result.Err()
+}
+
+// Print totals for the window and the intervals where realtime coverage dropped
+func report(logger *slog.Logger, results []*minuteEnergy, location *time.Location) {
+	var realtime, trend float64
+	var lowStart *minuteEnergy
+	var lowCount int
+	for i, m := range results {
+		if m.HaveTrend {
+			realtime += m.RealtimeConsumption
+			trend += m.TrendConsumption
+		}
+
+		if m.LowCoverage && lowStart == nil {
+			lowStart = m
+		}
+		if lowStart != nil && (!m.LowCoverage || i == len(results)-1) {
+			stop := m.Start
+			if m.LowCoverage {
+				stop = m.Start.Add(time.Minute)
+			}
+			logger.Warn("Low realtime coverage",
+				"start", lowStart.Start.In(location).Format(time.RFC3339),
+				"end", stop.In(location).Format(time.RFC3339))
+			lowStart = nil
+		}
+		if m.LowCoverage {
+			lowCount++
+		}
+	}
+
+	logger.Info("Reconciled consumption (Wh)",
+		"realtime", realtime, "trend", trend, "difference", realtime-trend,
+		"lowCoverageMinutes", lowCount, "minutes", len(results))
+}
+
+// Discrepancy points, minutes without trend data haven't been published by Sense yet so skip them
+func makePoints(measurement string, monitorID int64, results []*minuteEnergy) []*write.Point {
+	batch := make([]*write.Point, 0, len(results))
+	for _, m := range results {
+		if !m.HaveTrend {
+			continue
+		}
+
+		fields := map[string]interface{}{
+			"realtime_consumption": m.RealtimeConsumption,
+			"trend_consumption":    m.TrendConsumption,
+			"consumption_diff":     m.RealtimeConsumption - m.TrendConsumption,
+			"realtime_production":  m.RealtimeProduction,
+			"trend_production":     m.TrendProduction,
+			"production_diff":      m.RealtimeProduction - m.TrendProduction,
+			"coverage":             m.Coverage,
+			"low_coverage":         m.LowCoverage,
+		}
+
+		tags := map[string]string{
+			"monitorID": fmt.Sprintf("%d", monitorID),
+		}
+
+		batch = append(batch, write.NewPoint(measurement, tags, fields, m.Start))
+	}
+	return batch
+}
+
+// Flux values come back as float64 or int64 depending on how they were written
+func floatValue(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	}
+	return 0
+}
+
+func fatalOnErr(logger *slog.Logger, msg string, err error) {
+	if err != nil {
+		logging.Fatal(logger, msg, err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/david-lutz/sense_logger/alert"
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/sense"
+)
+
+// Check the trend points against the trend alert rules for the scale.  Rules don't keep
+// state between runs, so the whole period is checked each time and only events at the
+// newest point are sent, otherwise every run would repeat the period's earlier alerts.
+// Returns the last notification error once every rule has been checked.
+func checkAlerts(cfg *config.Config, scale sense.Scale, points []trendPoint, logger *slog.Logger) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	alertsCfg := cfg.Alerts
+	alertsCfg.Rules = nil
+	for _, ruleCfg := range cfg.Alerts.Rules {
+		if ruleCfg.Scale == "" || ruleCfg.Scale == scale.String() {
+			alertsCfg.Rules = append(alertsCfg.Rules, ruleCfg)
+		}
+	}
+	rules, err := alert.Rules(alertsCfg, alert.SourceTrend)
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+
+	location, err := time.LoadLocation(cfg.Sense.Credentials.TimeZone)
+	if err != nil {
+		return err
+	}
+
+	notifiers := alert.Notifiers(alertsCfg)
+	newest := points[len(points)-1].Timestamp
+	var notifyErr error
+	for _, p := range points {
+		// Alert on the cooked production, same as what we store
+		record := p.TrendRecord
+		record.Production = p.Cooked
+		fields := alert.TrendFields(record)
+
+		for _, rule := range rules {
+			event := rule.Check(p.Timestamp.In(location), fields)
+			if event != nil && p.Timestamp.Equal(newest) {
+				if _, err := alert.Notify(*event, notifiers, logger); err != nil {
+					notifyErr = err
+				}
+			}
+		}
+	}
+	return notifyErr
+}
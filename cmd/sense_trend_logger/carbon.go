@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/david-lutz/sense_logger/carbon"
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/sense"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Options for the "carbon" command
+type carbonCommand struct {
+	From   string `short:"f" long:"from" description:"First month, YYYY-MM (defaults to this month)"`
+	To     string `long:"to" description:"Last month, YYYY-MM (defaults to the first month)"`
+	Source string `long:"source" description:"Where to read hourly (DAY scale) trend data from" choice:"sense" choice:"influxdb" choice:"sqlite" default:"sense"`
+	DryRun bool   `short:"n" long:"dry-run" description:"Print the totals without writing them to InfluxDB"`
+}
+
+// Total CO2 estimates by month from the hourly DAY scale records, written to the InfluxDB
+// Carbon measurement keyed by the start of the month
+func (c *carbonCommand) run(cfg *config.Config, logger *slog.Logger) error {
+	location, err := time.LoadLocation(cfg.Sense.Credentials.TimeZone)
+	if err != nil {
+		return err
+	}
+	schedule, err := carbon.New(cfg.Carbon, location)
+	if err != nil {
+		return err
+	}
+	if schedule == nil {
+		return fmt.Errorf("no carbon emission factors configured")
+	}
+
+	now := time.Now().In(location)
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, location)
+	if c.From != "" {
+		if from, err = time.ParseInLocation("2006-01", c.From, location); err != nil {
+			return err
+		}
+	}
+	last := from
+	if c.To != "" {
+		if last, err = time.ParseInLocation("2006-01", c.To, location); err != nil {
+			return err
+		}
+	}
+	to := last.AddDate(0, 1, 0)
+	if to.After(now) {
+		to = now
+	}
+
+	rows, err := readTrendRows(cfg, c.Source, sense.Day, from, to, logger)
+	if err != nil {
+		return err
+	}
+	months, skipped := schedule.Monthly(rows)
+	if skipped > 0 {
+		logger.Warn("No emission factor for some hours, left out of the totals", "hours", skipped)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Month\tConsumption (kWh)\tGrid Import (kWh)\tCO2 (kg)\tCO2 Import (kg)\t")
+	for _, month := range months {
+		fmt.Fprintf(w, "%s\t%.2f\t%.2f\t%.2f\t%.2f\t\n", month.Start.Format("2006-01"),
+			month.Consumption, month.GridImport, month.CO2, month.CO2Import)
+	}
+	w.Flush()
+
+	if c.DryRun || len(months) == 0 {
+		return nil
+	}
+
+	client := influxdb2.NewClientWithOptions(
+		cfg.InfluxDB.Server.URL,
+		cfg.InfluxDB.Server.AuthToken(),
+		influxdb2.DefaultOptions().SetPrecision(time.Second))
+	defer client.Close()
+
+	writeAPI := client.WriteAPIBlocking(
+		cfg.InfluxDB.Server.OrgName(),
+		cfg.InfluxDB.Carbon.BucketName(cfg.InfluxDB.Server))
+
+	batch := make([]*write.Point, 0, len(months))
+	for _, month := range months {
+		tags := map[string]string{
+			"monitorID": fmt.Sprintf("%d", cfg.Sense.Credentials.MonitorID),
+		}
+		fields := map[string]interface{}{
+			"consumption":   month.Consumption,
+			"grid_import":   month.GridImport,
+			"co2_kg":        month.CO2,
+			"co2_import_kg": month.CO2Import,
+		}
+		batch = append(batch, write.NewPoint(cfg.InfluxDB.Carbon.Measurement, tags, fields, month.Start))
+	}
+	if err := writeAPI.WritePoint(context.Background(), batch...); err != nil {
+		return err
+	}
+
+	logger.Info("Carbon totals logged", "from", from, "to", to, "months", len(months))
+	return nil
+}
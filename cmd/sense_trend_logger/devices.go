@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/sense"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Write per device energy to the InfluxDB Devices measurement, tagged by device and scale
+// since every scale shares the measurement.  Only steps that have trend points are written,
+// the rest are empty future steps.  Devices Sense only sent a total for are tagged
+// total=true, so they aren't summed along with per step values.
+func writeDeviceTrend(cfg *config.Config, scale sense.Scale, records []sense.DeviceTrendRecord, points []trendPoint) (int, error) {
+	if cfg.InfluxDB.Devices.Measurement == "" || len(records) == 0 || len(points) == 0 {
+		return 0, nil
+	}
+
+	steps := make(map[int64]bool, len(points))
+	for _, p := range points {
+		steps[p.Timestamp.Unix()] = true
+	}
+
+	batch := make([]*write.Point, 0, len(records))
+	for _, r := range records {
+		if !r.Total && !steps[r.Timestamp.Unix()] {
+			continue
+		}
+		tags := map[string]string{
+			"monitorID":   fmt.Sprintf("%d", cfg.Sense.Credentials.MonitorID),
+			"scale":       scale.String(),
+			"device_id":   r.DeviceID,
+			"device_name": r.Name,
+		}
+		if r.Total {
+			tags["total"] = "true"
+		}
+		field := "consumption"
+		if r.Production {
+			field = "production"
+		}
+		fields := map[string]interface{}{
+			field: r.Energy,
+		}
+		batch = append(batch, write.NewPoint(cfg.InfluxDB.Devices.Measurement, tags, fields, r.Timestamp))
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	client := influxdb2.NewClientWithOptions(
+		cfg.InfluxDB.Server.URL,
+		cfg.InfluxDB.Server.AuthToken(),
+		influxdb2.DefaultOptions().SetPrecision(time.Second))
+	defer client.Close()
+
+	writeAPI := client.WriteAPIBlocking(
+		cfg.InfluxDB.Server.OrgName(),
+		cfg.InfluxDB.Devices.BucketName(cfg.InfluxDB.Server))
+	if err := writeAPI.WritePoint(context.Background(), batch...); err != nil {
+		return 0, err
+	}
+	return len(batch), nil
+}
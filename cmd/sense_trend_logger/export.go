@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/solar"
+	"github.com/david-lutz/sense_logger/sqlite"
+	"github.com/david-lutz/sense_logger/store"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/mitchellh/go-homedir"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Pause between trend requests so we don't hammer the Sense API
+const trendRequestDelay = 250 * time.Millisecond
+
+// Options for the "export" command
+type exportCommand struct {
+	Scale  string `short:"s" long:"scale" description:"Scale" choice:"HOUR" choice:"DAY" choice:"MONTH" choice:"YEAR" required:"true"`
+	From   string `short:"f" long:"from" description:"Start of the range, YYYY-MM-DD (monitor time zone) or RFC3339" required:"true"`
+	To     string `long:"to" description:"End of the range (exclusive), YYYY-MM-DD or RFC3339 (defaults to now)"`
+	Source string `long:"source" description:"Where to read trend data from" choice:"sense" choice:"influxdb" choice:"sqlite" default:"sense"`
+	Format string `long:"format" description:"Output format (defaults to the output file extension, or csv)" choice:"csv" choice:"parquet"`
+	Output string `long:"output" description:"Output file, - for stdout (csv only)" default:"-"`
+}
+
+// One exported trend record (kWh)
+type exportRow struct {
+	Timestamp     int64   `parquet:"timestamp,timestamp(millisecond)"`
+	LocalTime     string  `parquet:"local_time"`
+	Consumption   float64 `parquet:"consumption"`
+	RawProduction float64 `parquet:"raw_production"`
+	Production    float64 `parquet:"production"`
+	Net           float64 `parquet:"net"`
+}
+
+var exportHeader = []string{"timestamp", "consumption", "raw_production", "production", "net"}
+
+func (c *exportCommand) run(cfg *config.Config, logger *slog.Logger) error {
+	scale, err := sense.ParseScale(c.Scale)
+	if err != nil {
+		return err
+	}
+
+	location, err := time.LoadLocation(cfg.Sense.Credentials.TimeZone)
+	if err != nil {
+		return err
+	}
+
+	from, err := parseRangeTime(c.From, location)
+	if err != nil {
+		return err
+	}
+	to := time.Now().In(location)
+	if c.To != "" {
+		to, err = parseRangeTime(c.To, location)
+		if err != nil {
+			return err
+		}
+	}
+
+	format := c.Format
+	if format == "" {
+		format = "csv"
+		if strings.EqualFold(filepath.Ext(c.Output), ".parquet") {
+			format = "parquet"
+		}
+	}
+	if format == "parquet" && c.Output == "-" {
+		return fmt.Errorf("parquet output needs an output file")
+	}
+
+	rows, err := readTrendRows(cfg, c.Source, scale, from, to, logger)
+	if err != nil {
+		return err
+	}
+
+	results := make([]exportRow, len(rows))
+	for i, row := range rows {
+		results[i] = exportRow{
+			Timestamp:     row.Time.UnixMilli(),
+			LocalTime:     row.Time.In(location).Format(time.RFC3339),
+			Consumption:   row.Consumption,
+			RawProduction: row.RawProduction,
+			Production:    row.Production,
+			Net:           row.Consumption - row.Production,
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if c.Output != "-" {
+		filename, err := homedir.Expand(c.Output)
+		if err != nil {
+			return err
+		}
+		file, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if format == "parquet" {
+		err = writeParquet(w, results)
+	} else {
+		err = writeCSV(w, results)
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Exported trend data", "scale", scale, "source", c.Source, "format", format,
+		"from", from, "to", to, "records", len(results))
+	return nil
+}
+
+// Read trend rows for [from, to) from Sense ("sense") or from what sense_trend_logger wrote
+// to "influxdb" or "sqlite"
+func readTrendRows(cfg *config.Config, source string, scale sense.Scale, from, to time.Time, logger *slog.Logger) ([]store.TrendRow, error) {
+	batchCfg := scaleConfig(cfg, scale)
+	switch source {
+	case "sense":
+		return trendRowsFromSense(cfg, scale, from, to, logger)
+	case "influxdb":
+		return trendRowsFromInfluxDB(cfg, batchCfg, from, to)
+	case "sqlite":
+		return trendRowsFromSQLite(cfg, batchCfg, from, to)
+	}
+	return nil, fmt.Errorf("invalid source: %s", source)
+}
+
+// Dates are midnight in the monitor's time zone
+func parseRangeTime(str string, location *time.Location) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", str, location); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, str)
+}
+
+// Fetch each period in the range from Sense, dropping empty and out of range records
+func trendRowsFromSense(cfg *config.Config, scale sense.Scale, from, to time.Time, logger *slog.Logger) ([]store.TrendRow, error) {
+	location, err := time.LoadLocation(cfg.Sense.Credentials.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	cooker, err := solar.NewCooker(cfg, location)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[int64]bool)
+	var rows []store.TrendRow
+	for t := scale.Period(from, location); t.Before(to); t = scale.NextPeriod(t) {
+		trendRecords, err := sense.GetTrendData(cfg.Sense.Credentials, scale, t.UTC(), logger)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range filterPoints(cooker, trendRecords) {
+			if p.Timestamp.Before(from) || !p.Timestamp.Before(to) || seen[p.Timestamp.Unix()] {
+				continue
+			}
+			seen[p.Timestamp.Unix()] = true
+			rows = append(rows, storeRows([]trendPoint{p})...)
+		}
+		time.Sleep(trendRequestDelay)
+	}
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Time.Before(rows[j].Time) })
+	return rows, nil
+}
+
+// Read back what sense_trend_logger wrote to InfluxDB
+func trendRowsFromInfluxDB(cfg *config.Config, batchCfg config.InfluxDBBatchConfig, from, to time.Time) ([]store.TrendRow, error) {
+	written, err := writtenRowsFromInfluxDB(cfg, batchCfg, from, to)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]store.TrendRow, len(written))
+	for i, row := range written {
+		rows[i] = row.TrendRow
+	}
+	return rows, nil
+}
+
+// Read back what sense_trend_logger wrote to InfluxDB along with when each point was written
+func writtenRowsFromInfluxDB(cfg *config.Config, batchCfg config.InfluxDBBatchConfig, from, to time.Time) ([]writtenRow, error) {
+	client := influxdb2.NewClient(cfg.InfluxDB.Server.URL, cfg.InfluxDB.Server.AuthToken())
+	defer client.Close()
+
+	query := fmt.Sprintf(`from(bucket: %q)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %q and r.monitorID == "%d")
+  |> filter(fn: (r) => r._field == "consumption" or r._field == "raw_production" or r._field == "production" or r._field == "written")
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group()
+  |> sort(columns: ["_time"])`,
+		batchCfg.BucketName(cfg.InfluxDB.Server),
+		from.Format(time.RFC3339), to.Format(time.RFC3339),
+		batchCfg.Measurement, cfg.Sense.Credentials.MonitorID)
+
+	result, err := client.QueryAPI(cfg.InfluxDB.Server.OrgName()).Query(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var rows []writtenRow
+	for result.Next() {
+		record := result.Record()
+		row := writtenRow{TrendRow: store.TrendRow{
+			Time:          record.Time(),
+			Consumption:   floatValue(record.ValueByKey("consumption")),
+			RawProduction: floatValue(record.ValueByKey("raw_production")),
+			Production:    floatValue(record.ValueByKey("production")),
+		}}
+		if written, ok := record.ValueByKey("written").(int64); ok {
+			row.Written = time.Unix(written, 0)
+		}
+		rows = append(rows, row)
+	}
+	return rows, result.Err()
+}
+
+// Read back what sense_trend_logger wrote to SQLite
+func trendRowsFromSQLite(cfg *config.Config, batchCfg config.InfluxDBBatchConfig, from, to time.Time) ([]store.TrendRow, error) {
+	if cfg.SQLite.File == "" {
+		return nil, fmt.Errorf("no SQLite file configured")
+	}
+	filename, err := homedir.Expand(cfg.SQLite.File)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sqlite.Open(filename, cfg.Sense.Credentials.MonitorID)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return db.TrendRows(context.Background(), batchCfg.Measurement, from, to)
+}
+
+func writeCSV(w io.Writer, rows []exportRow) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(exportHeader); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		err := writer.Write([]string{
+			row.LocalTime,
+			strconv.FormatFloat(row.Consumption, 'f', -1, 64),
+			strconv.FormatFloat(row.RawProduction, 'f', -1, 64),
+			strconv.FormatFloat(row.Production, 'f', -1, 64),
+			strconv.FormatFloat(row.Net, 'f', -1, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeParquet(w io.Writer, rows []exportRow) error {
+	writer := parquet.NewGenericWriter[exportRow](w)
+	if _, err := writer.Write(rows); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// Flux values come back as float64 or int64 depending on how they were written
+func floatValue(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	}
+	return 0
+}
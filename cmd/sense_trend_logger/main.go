@@ -3,37 +3,94 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
 	"time"
 
+	"github.com/david-lutz/sense_logger/carbon"
 	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/logging"
+	"github.com/david-lutz/sense_logger/postgres"
 	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/solar"
+	"github.com/david-lutz/sense_logger/sqlite"
+	"github.com/david-lutz/sense_logger/store"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/go-homedir"
 )
 
 func main() {
 	// Command Line Options
 	var opts struct {
-		ConfigFile string `short:"c" long:"config" description:"Config file path" default:"~/.sense_logger.toml"`
-		Scale      string `short:"s" long:"scale" description:"Scale" choice:"HOUR" choice:"DAY" choice:"MONTH" choice:"YEAR" required:"true"`
-		Offset     string `short:"o" long:"offset" description:"Offset from now() for start time"`
-		Start      string `short:"t" long:"timestamp" description:"Timestamp in RFC3339 format (defaults to now())"`
-		Verbose    bool   `short:"v" long:"verbose" description:"Verbose mode"`
+		ConfigFile string          `short:"c" long:"config" description:"Config file path" default:"~/.sense_logger.toml"`
+		Scale      string          `short:"s" long:"scale" description:"Scale (required unless running a command)" choice:"HOUR" choice:"DAY" choice:"MONTH" choice:"YEAR"`
+		Offset     string          `short:"o" long:"offset" description:"Offset from now() for start time"`
+		Start      string          `short:"t" long:"timestamp" description:"Timestamp in RFC3339 format (defaults to now())"`
+		Force      bool            `long:"force" description:"Rewrite every point to InfluxDB, even if unchanged (i.e. after changing carbon or solar settings)"`
+		Logging    logging.Options `group:"Logging Options"`
+	}
+	var exportCmd exportCommand
+	var carbonCmd carbonCommand
+	var performanceCmd performanceCommand
+	var rollupCmd rollupCommand
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+	parser.AddCommand("export", "Export trend history",
+		"Export a range of trend history to CSV or Parquet, from Sense or from a configured store", &exportCmd)
+	parser.AddCommand("carbon", "Monthly CO2 totals",
+		"Estimate monthly CO2 totals from hourly trend data and the configured emission factors", &carbonCmd)
+	parser.AddCommand("performance", "Solar performance against clear-sky expectations",
+		"Compare hourly production with the clear-sky model of the configured array, writing expected production and performance ratios", &performanceCmd)
+	parser.AddCommand("rollup", "Derive coarser scales from per minute data",
+		"Aggregate stored per minute (HOUR scale) trend data into hourly, daily and monthly totals for the RollupDay, RollupMonth and RollupYear measurements", &rollupCmd)
+	_, err := parser.Parse()
+	if err != nil {
+		// go-flags has already printed the error or help message
+		if flags.WroteHelp(err) {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+
+	logger, err := opts.Logging.New()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Load Config
+	cfg, err := config.LoadConfig(opts.ConfigFile, true)
+	fatalOnErr(logger, "Loading config", err)
+
+	// Commands
+	if parser.Active != nil {
+		switch parser.Active.Name {
+		case "export":
+			fatalOnErr(logger, "Exporting trend data", exportCmd.run(cfg, logger))
+		case "carbon":
+			fatalOnErr(logger, "Estimating carbon totals", carbonCmd.run(cfg, logger))
+		case "performance":
+			fatalOnErr(logger, "Tracking solar performance", performanceCmd.run(cfg, logger))
+		case "rollup":
+			fatalOnErr(logger, "Rolling up trend data", rollupCmd.run(cfg, logger))
+		}
+		return
 	}
-	_, err := flags.Parse(&opts)
-	fatalOnErr(err)
 
 	// Scale: Hour, Day, Month, or Year
+	if opts.Scale == "" {
+		fatalOnErr(logger, "Parsing scale", fmt.Errorf("the required flag `-s, --scale' was not specified"))
+	}
 	scale, err := sense.ParseScale(opts.Scale)
-	fatalOnErr(err)
+	fatalOnErr(logger, "Parsing scale", err)
 
 	// Offset, defaults to 0s
 	offset := 0 * time.Second
 	if opts.Offset != "" {
 		offset, err = time.ParseDuration(opts.Offset)
-		fatalOnErr(err)
+		fatalOnErr(logger, "Parsing offset", err)
 	}
 
 	// Start Time, defaults to now() - offset
@@ -41,60 +98,210 @@ func main() {
 	if opts.Start != "" {
 		starttime, err = time.Parse(time.RFC3339, opts.Start)
 		starttime = starttime.UTC()
-		fatalOnErr(err)
+		fatalOnErr(logger, "Parsing timestamp", err)
 	}
 
-	// Load Config
-	cfg, err := config.LoadConfig(opts.ConfigFile, true)
-	fatalOnErr(err)
+	location, err := time.LoadLocation(cfg.Sense.Credentials.TimeZone)
+	fatalOnErr(logger, "Loading time zone", err)
 
 	// Get Trend Data from Sense
-	trendRecords, err := sense.GetTrendData(cfg.Sense.Credentials, scale, starttime, opts.Verbose)
-	fatalOnErr(err)
+	response, err := sense.GetTrendResponse(cfg.Sense.Credentials, scale, starttime, logger)
+	fatalOnErr(logger, "Getting trend data", err)
+	trendRecords, err := response.Records(scale, location)
+	fatalOnErr(logger, "Getting trend data", err)
+	deviceRecords, err := response.DeviceRecords(scale, location)
+	fatalOnErr(logger, "Getting device trend data", err)
+
+	// Production cooking model, shared with the realtime logger
+	cooker, err := solar.NewCooker(cfg, location)
+	fatalOnErr(logger, "Setting up production model", err)
+
+	// Filter out TrendRecords with no data, the Sense API will fill return empty
+	// future records when we are part way through a time period
+	points := filterPoints(cooker, trendRecords)
+
+	// The learned baseline is only a cache, losing it mustn't lose the trend data
+	if err := cooker.Save(); err != nil {
+		logger.Warn("Saving production state", "err", err)
+	}
+
+	// Write to InfluxDB and the SQL stores
+	fatalOnErr(logger, "Writing trend data", writeTrend(cfg, scale, scaleConfig(cfg, scale), location, points, true, opts.Force, logger))
+
+	// Per device breakdown
+	devicePoints, err := writeDeviceTrend(cfg, scale, deviceRecords, points)
+	fatalOnErr(logger, "Writing device trend data to InfluxDB", err)
+
+	// Threshold alerts over the trend data
+	fatalOnErr(logger, "Checking alerts", checkAlerts(cfg, scale, points, logger))
+
+	logger.Info("Trend data logged", "scale", scale, "start", starttime, "records", len(trendRecords), "points", len(points),
+		"devicePoints", devicePoints)
+}
+
+// Write trend points for the scale to the batchCfg measurement in InfluxDB and the SQL stores.
+// Only points that are new or changed since the last write go to InfluxDB unless force is
+// set, with trackRevisions the changes Sense made are recorded as revisions.
+func writeTrend(cfg *config.Config, scale sense.Scale, batchCfg config.InfluxDBBatchConfig, location *time.Location, points []trendPoint, trackRevisions bool, force bool, logger *slog.Logger) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	// CO2 estimates are only made for steps of an hour or less
+	var schedule *carbon.Schedule
+	if scale == sense.Hour || scale == sense.Day {
+		var err error
+		if schedule, err = carbon.New(cfg.Carbon, location); err != nil {
+			return fmt.Errorf("loading carbon schedule: %w", err)
+		}
+	}
+
+	// Clear-sky performance is tracked on the hourly DAY scale records
+	var model *solar.Model
+	if scale == sense.Day {
+		var err error
+		if model, err = solar.NewModel(cfg.Solar); err != nil {
+			return fmt.Errorf("loading solar model: %w", err)
+		}
+	}
+
+	// Write to InfluxDB
+	client := influxdb2.NewClientWithOptions(
+		cfg.InfluxDB.Server.URL,
+		cfg.InfluxDB.Server.AuthToken(),
+		influxdb2.DefaultOptions().SetPrecision(time.Second))
+	defer client.Close()
+
+	writeAPI := client.WriteAPIBlocking(
+		cfg.InfluxDB.Server.OrgName(),
+		batchCfg.BucketName(cfg.InfluxDB.Server))
+
+	// Only write points that are new or that have been revised since the last run
+	changed := points
+	var revisions []revision
+	if !force {
+		last := points[len(points)-1].Timestamp
+		existing, err := writtenRowsFromInfluxDB(cfg, batchCfg, points[0].Timestamp, last.Add(time.Second))
+		if err != nil {
+			logger.Warn("Reading existing trend data, rewriting every point", "err", err)
+		} else {
+			changed, revisions = diffPoints(existing, points, time.Now())
+			if !trackRevisions {
+				revisions = nil
+			}
+		}
+	}
+
+	if len(changed) > 0 {
+		// The write time tells later runs whether a record was complete when it was written
+		written := time.Now().Unix()
+		batch := influxPoints(batchCfg.Measurement, cfg.Sense.Credentials.MonitorID, changed, schedule, model)
+		for _, point := range batch {
+			point.AddField("written", written)
+		}
+		if err := writeAPI.WritePoint(context.Background(), batch...); err != nil {
+			return fmt.Errorf("writing to InfluxDB: %w", err)
+		}
+	}
+
+	// Revisions are only a record of the changes, losing them mustn't stop the trend writes
+	revisionsAPI := client.WriteAPIBlocking(
+		cfg.InfluxDB.Server.OrgName(),
+		cfg.InfluxDB.Revisions.BucketName(cfg.InfluxDB.Server))
+	if err := recordRevisions(cfg, revisionsAPI, scale, revisions, logger); err != nil {
+		logger.Warn("Writing revisions to InfluxDB", "err", err)
+	}
+	logger.Debug("InfluxDB trend write", "scale", scale, "points", len(points), "written", len(changed), "unchanged", len(points)-len(changed))
+
+	// Write to PostgreSQL, the table is named after the measurement
+	if cfg.Postgres.URL != "" {
+		db, err := postgres.Connect(context.Background(), cfg.Postgres.URL,
+			cfg.Sense.Credentials.MonitorID, cfg.Postgres.TimescaleDB)
+		if err != nil {
+			return fmt.Errorf("connecting to PostgreSQL: %w", err)
+		}
+		defer db.Close()
 
-	// Get the right config for the scale, if the data points are going to be
-	// larger than 1 hour, we don't worry about the the productionThreshold
-	var batchCfg config.InfluxDBBatchConfig
-	productionThreshold := float64(0)
+		if err := db.WriteTrend(context.Background(), batchCfg.Measurement, storeRows(points)); err != nil {
+			return fmt.Errorf("writing to PostgreSQL: %w", err)
+		}
+	}
+
+	// Write to SQLite, the table is named after the measurement
+	if cfg.SQLite.File != "" {
+		filename, err := homedir.Expand(cfg.SQLite.File)
+		if err != nil {
+			return err
+		}
+		db, err := sqlite.Open(filename, cfg.Sense.Credentials.MonitorID)
+		if err != nil {
+			return fmt.Errorf("opening SQLite: %w", err)
+		}
+		defer db.Close()
+
+		if err := db.WriteTrend(context.Background(), batchCfg.Measurement, storeRows(points)); err != nil {
+			return fmt.Errorf("writing to SQLite: %w", err)
+		}
+	}
+	return nil
+}
+
+// Get the right config for the scale
+func scaleConfig(cfg *config.Config, scale sense.Scale) config.InfluxDBBatchConfig {
 	switch scale {
 	case sense.Hour:
-		batchCfg = cfg.InfluxDB.Hour
-		productionThreshold = cfg.Sense.ProductionThreshold / 1000.0 / 60.0
+		return cfg.InfluxDB.Hour
 	case sense.Day:
-		batchCfg = cfg.InfluxDB.Day
-		productionThreshold = cfg.Sense.ProductionThreshold / 1000.0
+		return cfg.InfluxDB.Day
 	case sense.Month:
-		batchCfg = cfg.InfluxDB.Month
-	case sense.Year:
-		batchCfg = cfg.InfluxDB.Year
+		return cfg.InfluxDB.Month
+	default:
+		return cfg.InfluxDB.Year
 	}
+}
 
-	// Filter out TrendRecords with no data, the Sense API will fill return empty
-	// future records when we are part way through a time period
-	batch := filterPoints(batchCfg.Measurement, cfg.Sense.Credentials.MonitorID,
-		productionThreshold, trendRecords)
-
-	// Write to InfluxDB if we have any data
-	if len(batch) > 0 {
-		client := influxdb2.NewClientWithOptions(
-			cfg.InfluxDB.Server.URL,
-			cfg.InfluxDB.Server.Token,
-			influxdb2.DefaultOptions().SetPrecision(time.Second))
-		defer client.Close()
+// Length of a TrendRecord's step, Week, Month and Year steps follow the local calendar
+func trendStep(record sense.TrendRecord) time.Duration {
+	return record.Scale.Next(record.Timestamp).Sub(record.Timestamp)
+}
 
-		writeAPI := client.WriteAPIBlocking(
-			cfg.InfluxDB.Server.Org,
-			batchCfg.Bucket)
+// A TrendRecord with its cooked production value
+type trendPoint struct {
+	sense.TrendRecord
+	Cooked float64
+	Solar  *sense.SolarSplit // Summed from finer steps by a rollup, nil if not rolled up
+}
 
-		err := writeAPI.WritePoint(context.Background(), batch...)
-		fatalOnErr(err)
+// Grid import/export split of the point.  Splitting a whole day or month nets midday export
+// against evening import, so MONTH and YEAR points only have one when rolled up.
+func (p trendPoint) solarSplit() (sense.SolarSplit, bool) {
+	switch {
+	case p.Solar != nil:
+		return *p.Solar, true
+	case p.Scale == sense.Hour || p.Scale == sense.Day:
+		return sense.Split(p.Consumption, p.Cooked), true
+	default:
+		return sense.SolarSplit{}, false
 	}
 }
 
-// Add TrendRecords to a batch if they are non-zero, adjusting the produciton value along the way
-func filterPoints(measurement string, monitorID int64, threshold float64, trendRecords []sense.TrendRecord) []*write.Point {
+// Keep TrendRecords that are non-zero, adjusting the produciton value along the way
+func filterPoints(cooker *solar.Cooker, trendRecords []sense.TrendRecord) []trendPoint {
+	// Learn the baseline from night time records before cooking them.  The step still in
+	// progress only covers part of its length, so it would read as a lower average.
+	now := time.Now()
+	for _, trendRecord := range trendRecords {
+		if trendRecord.Consumption == 0 && trendRecord.Production == 0 {
+			continue
+		}
+		step := trendStep(trendRecord)
+		if trendRecord.Timestamp.Add(step).After(now) {
+			continue
+		}
+		cooker.Learn(trendRecord.Timestamp, step, trendRecord.Production*1000/step.Hours())
+	}
 
-	batch := make([]*write.Point, 0, len(trendRecords))
+	points := make([]trendPoint, 0, len(trendRecords))
 	for _, trendRecord := range trendRecords {
 		// Filter out missing data
 		if trendRecord.Consumption == 0 && trendRecord.Production == 0 {
@@ -103,30 +310,72 @@ func filterPoints(measurement string, monitorID int64, threshold float64, trendR
 
 		// Sense always sees a small amount of Solar Production, even in the middle of the night.
 		// The "cooked" production tries to reset these values back to zero.
-		cooked := trendRecord.Production
-		if cooked < threshold {
-			cooked = 0.0
-		}
+		cooked := cooker.CookEnergy(trendRecord.Timestamp, trendStep(trendRecord), trendRecord.Production)
+
+		points = append(points, trendPoint{TrendRecord: trendRecord, Cooked: cooked})
+	}
+
+	return points
+}
 
+// Map trend points to InfluxDB points, with the grid split where the step is short enough
+// (see solarSplit), CO2 estimates if there is an emissions schedule and expected production
+// if there is a solar model
+func influxPoints(measurement string, monitorID int64, points []trendPoint, schedule *carbon.Schedule, model *solar.Model) []*write.Point {
+	batch := make([]*write.Point, 0, len(points))
+	for _, p := range points {
 		fields := map[string]interface{}{
-			"consumption":    trendRecord.Consumption,
-			"raw_production": trendRecord.Production,
-			"production":     cooked,
+			"consumption":    p.Consumption,
+			"raw_production": p.Production,
+			"production":     p.Cooked,
+		}
+		if split, ok := p.solarSplit(); ok {
+			fields["grid_import"] = split.GridImport
+			fields["grid_export"] = split.GridExport
+			fields["self_consumed"] = split.SelfConsumed
+			fields["self_sufficiency"] = split.SelfSufficiency()
+			fields["self_consumption"] = split.SelfConsumption()
+		}
+		if schedule != nil {
+			// Left out where no factor covers the step rather than written as zero
+			if emissions, ok := schedule.Estimate(p.Timestamp, p.Consumption, p.Cooked); ok {
+				fields["co2_kg"] = emissions.CO2
+				fields["co2_import_kg"] = emissions.CO2Import
+			}
+		}
+		if model != nil {
+			perf := model.Performance(p.Timestamp, p.Timestamp.Add(trendStep(p.TrendRecord)), p.Cooked)
+			for name, value := range performanceFields(perf) {
+				fields[name] = value
+			}
 		}
 
 		tags := map[string]string{
 			"monitorID": fmt.Sprintf("%d", monitorID),
 		}
 
-		point := write.NewPoint(measurement, tags, fields, trendRecord.Timestamp)
+		point := write.NewPoint(measurement, tags, fields, p.Timestamp)
 		batch = append(batch, point)
 	}
-
 	return batch
 }
 
-func fatalOnErr(err error) {
+// Map trend points to SQL store rows
+func storeRows(points []trendPoint) []store.TrendRow {
+	rows := make([]store.TrendRow, 0, len(points))
+	for _, p := range points {
+		rows = append(rows, store.TrendRow{
+			Time:          p.Timestamp,
+			Consumption:   p.Consumption,
+			RawProduction: p.Production,
+			Production:    p.Cooked,
+		})
+	}
+	return rows
+}
+
+func fatalOnErr(logger *slog.Logger, msg string, err error) {
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logger, msg, err)
 	}
 }
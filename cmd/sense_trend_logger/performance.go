@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/solar"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Options for the "performance" command
+type performanceCommand struct {
+	From   string `short:"f" long:"from" description:"First day, YYYY-MM-DD (defaults to yesterday)"`
+	To     string `long:"to" description:"Last day, YYYY-MM-DD (defaults to the first day)"`
+	Source string `long:"source" description:"Where to read hourly (DAY scale) trend data from" choice:"sense" choice:"influxdb" choice:"sqlite" default:"sense"`
+	DryRun bool   `short:"n" long:"dry-run" description:"Print the daily summary without writing to InfluxDB"`
+}
+
+// Expected production and, when enough production was expected, the performance ratio
+func performanceFields(perf solar.Performance) map[string]interface{} {
+	fields := map[string]interface{}{
+		"expected_production": perf.Expected,
+	}
+	if perf.Rated {
+		fields["performance_ratio"] = perf.Ratio
+	}
+	return fields
+}
+
+// Compare hourly (DAY scale) production against the clear-sky model over a range of days,
+// writing expected_production and performance_ratio next to the production values in the
+// InfluxDB Day measurement
+func (c *performanceCommand) run(cfg *config.Config, logger *slog.Logger) error {
+	model, err := solar.NewModel(cfg.Solar)
+	if err != nil {
+		return err
+	}
+	if model == nil {
+		return fmt.Errorf("no solar array capacity configured")
+	}
+
+	location, err := time.LoadLocation(cfg.Sense.Credentials.TimeZone)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(location)
+	from := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, location)
+	if c.From != "" {
+		if from, err = time.ParseInLocation("2006-01-02", c.From, location); err != nil {
+			return err
+		}
+	}
+	last := from
+	if c.To != "" {
+		if last, err = time.ParseInLocation("2006-01-02", c.To, location); err != nil {
+			return err
+		}
+	}
+	to := last.AddDate(0, 0, 1)
+	if to.After(now) {
+		to = now
+	}
+
+	rows, err := readTrendRows(cfg, c.Source, sense.Day, from, to, logger)
+	if err != nil {
+		return err
+	}
+
+	tags := map[string]string{
+		"monitorID": fmt.Sprintf("%d", cfg.Sense.Credentials.MonitorID),
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Date\tProduction (kWh)\tExpected (kWh)\tRatio\t")
+	var day string
+	var production, expected float64
+	printDay := func() {
+		if day == "" {
+			return
+		}
+		ratio := "-"
+		if expected > 0 {
+			ratio = fmt.Sprintf("%.0f%%", production/expected*100)
+		}
+		fmt.Fprintf(w, "%s\t%.2f\t%.2f\t%s\t\n", day, production, expected, ratio)
+	}
+
+	batch := make([]*write.Point, 0, len(rows))
+	for _, row := range rows {
+		if date := row.Time.In(location).Format("2006-01-02"); date != day {
+			printDay()
+			day, production, expected = date, 0, 0
+		}
+		perf := model.Performance(row.Time, row.Time.Add(time.Hour), row.Production)
+		production += row.Production
+		expected += perf.Expected
+		batch = append(batch, write.NewPoint(cfg.InfluxDB.Day.Measurement, tags, performanceFields(perf), row.Time))
+	}
+	printDay()
+	w.Flush()
+
+	if c.DryRun || len(batch) == 0 {
+		return nil
+	}
+
+	client := influxdb2.NewClientWithOptions(
+		cfg.InfluxDB.Server.URL,
+		cfg.InfluxDB.Server.AuthToken(),
+		influxdb2.DefaultOptions().SetPrecision(time.Second))
+	defer client.Close()
+
+	writeAPI := client.WriteAPIBlocking(
+		cfg.InfluxDB.Server.OrgName(),
+		cfg.InfluxDB.Day.BucketName(cfg.InfluxDB.Server))
+	if err := writeAPI.WritePoint(context.Background(), batch...); err != nil {
+		return err
+	}
+
+	logger.Info("Solar performance logged", "from", from, "to", to, "points", len(batch))
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/store"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Values within this of each other are unchanged, floats read back from InfluxDB round trip
+// exactly so this only absorbs floating point rounding
+const revisionTolerance = 1e-9
+
+// A change to a trend value that was already written
+type revision struct {
+	Time     time.Time // Start of the revised record
+	Field    string
+	Old      float64
+	New      float64
+	Detected time.Time
+	Age      time.Duration // From the end of the record's step until the revision was seen
+}
+
+// A trend row read back from InfluxDB and when it was written, zero for points written
+// before the write time was recorded
+type writtenRow struct {
+	store.TrendRow
+	Written time.Time
+}
+
+// Compare points with what was already written, returning the points that are new or
+// changed and the revisions (old vs new value) of the changed ones.  Only the values Sense
+// reports are revisions, cooked production also changes whenever the learned baseline does,
+// so those points are rewritten without recording a revision.  Neither are records that were
+// still in progress when they were written, their values were partial.  Without a write time
+// a record counts as complete once it ended a step before now.
+func diffPoints(existing []writtenRow, points []trendPoint, now time.Time) ([]trendPoint, []revision) {
+	written := make(map[int64]writtenRow, len(existing))
+	for _, row := range existing {
+		written[row.Time.Unix()] = row
+	}
+
+	var changed []trendPoint
+	var revisions []revision
+	for _, p := range points {
+		row, ok := written[p.Timestamp.Unix()]
+		if !ok {
+			changed = append(changed, p)
+			continue
+		}
+
+		step := trendStep(p.TrendRecord)
+		end := p.Timestamp.Add(step)
+		age := now.Sub(end)
+		complete := !row.Written.Before(end)
+		if row.Written.IsZero() {
+			complete = age >= step
+		}
+
+		revised := false
+		for _, field := range []struct {
+			name     string
+			old, new float64
+		}{
+			{"consumption", row.Consumption, p.Consumption},
+			{"raw_production", row.RawProduction, p.Production},
+		} {
+			if math.Abs(field.new-field.old) <= revisionTolerance {
+				continue
+			}
+			revised = true
+			if complete {
+				revisions = append(revisions, revision{
+					Time: p.Timestamp, Field: field.name, Old: field.old, New: field.new, Detected: now, Age: age,
+				})
+			}
+		}
+		if revised || math.Abs(p.Cooked-row.Production) > revisionTolerance {
+			changed = append(changed, p)
+		}
+	}
+	return changed, revisions
+}
+
+// Log each revision and, if the Revisions measurement is configured, write them to InfluxDB
+// at the time they were detected, so a record revised more than once keeps every revision.
+// The record tag holds the revised record's start, which also keeps the revisions found in
+// one run apart.
+func recordRevisions(cfg *config.Config, writeAPI api.WriteAPIBlocking, scale sense.Scale, revisions []revision, logger *slog.Logger) error {
+	if len(revisions) == 0 {
+		return nil
+	}
+
+	for _, r := range revisions {
+		logger.Info("Trend value revised", "scale", scale, "timestamp", r.Time, "field", r.Field,
+			"old", r.Old, "new", r.New, "age", r.Age.Round(time.Second))
+	}
+	if cfg.InfluxDB.Revisions.Measurement == "" {
+		return nil
+	}
+
+	batch := make([]*write.Point, 0, len(revisions))
+	for _, r := range revisions {
+		tags := map[string]string{
+			"monitorID": fmt.Sprintf("%d", cfg.Sense.Credentials.MonitorID),
+			"scale":     scale.String(),
+			"field":     r.Field,
+			"record":    r.Time.UTC().Format(time.RFC3339),
+		}
+		fields := map[string]interface{}{
+			"old":   r.Old,
+			"new":   r.New,
+			"delta": r.New - r.Old,
+			"age":   r.Age.Seconds(),
+		}
+		batch = append(batch, write.NewPoint(cfg.InfluxDB.Revisions.Measurement, tags, fields, r.Detected))
+	}
+	return writeAPI.WritePoint(context.Background(), batch...)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/store"
+)
+
+func TestDiffPoints(t *testing.T) {
+	start := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	minute := func(i int) time.Time { return start.Add(time.Duration(i) * time.Minute) }
+	point := func(i int, consumption, production, cooked float64) trendPoint {
+		return trendPoint{
+			TrendRecord: sense.TrendRecord{Timestamp: minute(i), Scale: sense.Hour, Consumption: consumption, Production: production},
+			Cooked:      cooked,
+		}
+	}
+	row := func(i int, consumption, production, cooked float64, written time.Time) writtenRow {
+		return writtenRow{
+			TrendRow: store.TrendRow{Time: minute(i), Consumption: consumption, RawProduction: production, Production: cooked},
+			Written:  written,
+		}
+	}
+	now := minute(30)
+
+	existing := []writtenRow{
+		row(0, 1, 2, 2, minute(5)),                   // Unchanged
+		row(1, 1, 2, 2, minute(5)),                   // Revised by Sense after it was complete
+		row(2, 1, 2, 2, minute(2).Add(-time.Second)), // Written while in progress
+		row(3, 1, 2, 2, minute(5)),                   // Only the cooked value changed
+		row(4, 1, 2, 2, time.Time{}),                 // No write time, long complete
+		row(29, 1, 2, 2, time.Time{}),                // No write time, only just ended
+		row(30, 1, 2, 2, minute(30)),                 // The record in progress now
+	}
+	points := []trendPoint{
+		point(0, 1, 2, 2),
+		point(1, 1.5, 2.5, 2.5),
+		point(2, 1.5, 2, 2),
+		point(3, 1, 2, 1.5),
+		point(4, 3, 2, 2),
+		point(29, 3, 2, 2),
+		point(30, 3, 2, 2),
+		point(31, 0, 0, 0), // New
+	}
+
+	changed, revisions := diffPoints(existing, points, now)
+
+	var changedTimes []time.Time
+	for _, p := range changed {
+		changedTimes = append(changedTimes, p.Timestamp)
+	}
+	wantChanged := []time.Time{minute(1), minute(2), minute(3), minute(4), minute(29), minute(30), minute(31)}
+	if len(changedTimes) != len(wantChanged) {
+		t.Fatalf("changed %v, want %v", changedTimes, wantChanged)
+	}
+	for i := range wantChanged {
+		if !changedTimes[i].Equal(wantChanged[i]) {
+			t.Errorf("changed %v, want %v", changedTimes, wantChanged)
+			break
+		}
+	}
+
+	want := []revision{
+		{Time: minute(1), Field: "consumption", Old: 1, New: 1.5, Detected: now, Age: 28 * time.Minute},
+		{Time: minute(1), Field: "raw_production", Old: 2, New: 2.5, Detected: now, Age: 28 * time.Minute},
+		{Time: minute(4), Field: "consumption", Old: 1, New: 3, Detected: now, Age: 25 * time.Minute},
+	}
+	if len(revisions) != len(want) {
+		t.Fatalf("got %d revisions %+v, want %d", len(revisions), revisions, len(want))
+	}
+	for i := range want {
+		if revisions[i] != want[i] {
+			t.Errorf("revision %d: %+v, want %+v", i, revisions[i], want[i])
+		}
+	}
+}
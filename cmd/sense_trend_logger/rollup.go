@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/store"
+)
+
+// Rollup totals further than this from Sense's own are reported
+const rollupTolerance = 0.01 // kWh
+
+// Scales rolled up from the per minute HOUR records, each record covers an hour, day or month
+var rollupScales = []sense.Scale{sense.Day, sense.Month, sense.Year}
+
+// Options for the "rollup" command
+type rollupCommand struct {
+	From    string `short:"f" long:"from" description:"First day, YYYY-MM-DD (defaults to yesterday)"`
+	To      string `long:"to" description:"Last day, YYYY-MM-DD (defaults to the first day)"`
+	Source  string `long:"source" description:"Where to read per minute (HOUR scale) trend data from" choice:"influxdb" choice:"sqlite" choice:"sense" default:"influxdb"`
+	Compare bool   `long:"compare" description:"Fetch Sense's own totals and report where they differ from the rollups"`
+	Force   bool   `long:"force" description:"Rewrite every point to InfluxDB, even if unchanged"`
+	DryRun  bool   `short:"n" long:"dry-run" description:"Don't write the rollups"`
+}
+
+// Each rolled up scale's records span one request period of the next scale down: hours for
+// DAY, days for MONTH and months for YEAR
+var rollupPeriods = map[sense.Scale]sense.Scale{
+	sense.Day:   sense.Hour,
+	sense.Month: sense.Day,
+	sense.Year:  sense.Month,
+}
+
+// Start of the rollup period containing t for a scale's records.  Periods follow the local
+// calendar, so DST days are 23 or 25 hours long and the repeated hour when clocks go back is
+// its own period.
+func rollupPeriod(scale sense.Scale, t time.Time, location *time.Location) time.Time {
+	return rollupPeriods[scale].Period(t, location)
+}
+
+// Sum time ordered per minute rows into the scale's periods, production is cooked and the
+// grid split made per minute
+func rollup(scale sense.Scale, rows []store.TrendRow, location *time.Location) []trendPoint {
+	var points []trendPoint
+	for _, row := range rows {
+		start := rollupPeriod(scale, row.Time, location)
+		if len(points) == 0 || !points[len(points)-1].Timestamp.Equal(start) {
+			points = append(points, trendPoint{
+				TrendRecord: sense.TrendRecord{Timestamp: start, Scale: scale},
+				Solar:       &sense.SolarSplit{},
+			})
+		}
+		p := &points[len(points)-1]
+		p.Consumption += row.Consumption
+		p.Production += row.RawProduction
+		p.Cooked += row.Production
+		*p.Solar = p.Solar.Add(sense.Split(row.Consumption, row.Production))
+	}
+	return points
+}
+
+// Get the rollup measurement config for the scale
+func rollupConfig(cfg *config.Config, scale sense.Scale) config.InfluxDBBatchConfig {
+	switch scale {
+	case sense.Day:
+		return cfg.InfluxDB.RollupDay
+	case sense.Month:
+		return cfg.InfluxDB.RollupMonth
+	default:
+		return cfg.InfluxDB.RollupYear
+	}
+}
+
+// Aggregate stored per minute trend data into hourly, daily and monthly totals, writing them
+// to the RollupDay, RollupMonth and RollupYear measurements.  They are kept apart from the
+// Day, Month and Year measurements the normal runs write Sense's totals to, differences
+// between the two are reported with --compare.  Months are always rolled up whole, so the per
+// minute data is read from the start of the first month.
+func (c *rollupCommand) run(cfg *config.Config, logger *slog.Logger) error {
+	location, err := time.LoadLocation(cfg.Sense.Credentials.TimeZone)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().In(location)
+	from := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, location)
+	if c.From != "" {
+		if from, err = time.ParseInLocation("2006-01-02", c.From, location); err != nil {
+			return err
+		}
+	}
+	last := from
+	if c.To != "" {
+		if last, err = time.ParseInLocation("2006-01-02", c.To, location); err != nil {
+			return err
+		}
+	}
+	to := last.AddDate(0, 0, 1)
+	if to.After(now) {
+		to = now
+	}
+	if !from.Before(to) {
+		return fmt.Errorf("nothing to roll up from %s", from.Format("2006-01-02"))
+	}
+	if !c.DryRun {
+		for _, scale := range rollupScales {
+			if rollupConfig(cfg, scale).Measurement == "" {
+				return fmt.Errorf("no rollup measurement configured for %s", scale)
+			}
+		}
+	}
+	monthFrom := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, location)
+	monthTo := time.Date(last.Year(), last.Month()+1, 1, 0, 0, 0, 0, location)
+	if monthTo.After(now) {
+		monthTo = now
+	}
+
+	rows, err := readTrendRows(cfg, c.Source, sense.Hour, monthFrom, monthTo, logger)
+	if err != nil {
+		return err
+	}
+	logger.Info("Read per minute trend data", "source", c.Source, "from", monthFrom, "to", monthTo, "rows", len(rows))
+
+	var differences []rollupDifference
+	for _, scale := range rollupScales {
+		periodFrom, periodTo := from, to
+		if scale == sense.Year {
+			periodFrom, periodTo = monthFrom, monthTo
+		}
+
+		var points []trendPoint
+		for _, p := range rollup(scale, rows, location) {
+			if !p.Timestamp.Before(periodFrom) && p.Timestamp.Before(periodTo) {
+				points = append(points, p)
+			}
+		}
+		if scale != sense.Day {
+			warnIncomplete(scale, points, rows, now, logger)
+		}
+
+		if c.Compare {
+			senseRows, err := readTrendRows(cfg, "sense", scale, periodFrom, periodTo, logger)
+			if err != nil {
+				return err
+			}
+			differences = append(differences, compareRollup(scale, points, senseRows)...)
+		}
+
+		if !c.DryRun {
+			if err := writeTrend(cfg, scale, rollupConfig(cfg, scale), location, points, false, c.Force, logger); err != nil {
+				return err
+			}
+		}
+		logger.Info("Trend data rolled up", "scale", scale, "from", periodFrom, "to", periodTo, "points", len(points))
+	}
+
+	if c.Compare {
+		printDifferences(differences)
+	}
+	return nil
+}
+
+// Warn about days and months with missing minutes, their totals fall short.  Periods still in
+// progress are only expected to be covered up to now.
+func warnIncomplete(scale sense.Scale, points []trendPoint, rows []store.TrendRow, now time.Time, logger *slog.Logger) {
+	minutes := make(map[int64]int, len(points))
+	for _, row := range rows {
+		minutes[rollupPeriod(scale, row.Time, now.Location()).Unix()]++
+	}
+	for _, p := range points {
+		end := p.Timestamp.Add(trendStep(p.TrendRecord))
+		if end.After(now) {
+			end = now
+		}
+		expected := int(end.Sub(p.Timestamp) / time.Minute)
+		if got := minutes[p.Timestamp.Unix()]; got < expected {
+			logger.Warn("Rollup period is missing per minute data", "scale", scale,
+				"start", p.Timestamp, "minutes", got, "expected", expected)
+		}
+	}
+}
+
+// A rollup total that differs from Sense's own
+type rollupDifference struct {
+	Scale                         sense.Scale
+	Start                         time.Time
+	Consumption, SenseConsumption float64
+	Production, SenseProduction   float64
+	Missing                       bool // Sense has no total for the period
+}
+
+// Compare rollups with Sense's totals for the same periods, using raw production since Sense
+// totals are cooked at their own scale
+func compareRollup(scale sense.Scale, points []trendPoint, senseRows []store.TrendRow) []rollupDifference {
+	totals := make(map[int64]store.TrendRow, len(senseRows))
+	for _, row := range senseRows {
+		totals[row.Time.Unix()] = row
+	}
+
+	var differences []rollupDifference
+	for _, p := range points {
+		row, ok := totals[p.Timestamp.Unix()]
+		d := rollupDifference{
+			Scale:            scale,
+			Start:            p.Timestamp,
+			Consumption:      p.Consumption,
+			SenseConsumption: row.Consumption,
+			Production:       p.Production,
+			SenseProduction:  row.RawProduction,
+			Missing:          !ok,
+		}
+		if d.Missing || math.Abs(d.Consumption-d.SenseConsumption) > rollupTolerance ||
+			math.Abs(d.Production-d.SenseProduction) > rollupTolerance {
+			differences = append(differences, d)
+		}
+	}
+	return differences
+}
+
+func printDifferences(differences []rollupDifference) {
+	if len(differences) == 0 {
+		fmt.Println("Rollups match Sense's totals")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Scale\tStart\tConsumption\tSense\tDiff\tProduction\tSense\tDiff\t")
+	for _, d := range differences {
+		if d.Missing {
+			fmt.Fprintf(w, "%s\t%s\t%.3f\t-\t-\t%.3f\t-\t-\t\n", d.Scale, d.Start.Format("2006-01-02 15:04 MST"),
+				d.Consumption, d.Production)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.3f\t%.3f\t%+.3f\t%.3f\t%.3f\t%+.3f\t\n", d.Scale, d.Start.Format("2006-01-02 15:04 MST"),
+			d.Consumption, d.SenseConsumption, d.Consumption-d.SenseConsumption,
+			d.Production, d.SenseProduction, d.Production-d.SenseProduction)
+	}
+	w.Flush()
+}
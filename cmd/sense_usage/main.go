@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/david-lutz/sense_logger/logging"
+	"github.com/david-lutz/sense_logger/sqlite"
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/go-homedir"
+)
+
+func main() {
+	// Command Line Options
+	var opts struct {
+		ConfigFile string          `short:"c" long:"config" description:"Config file path" default:"~/.sense_logger.toml"`
+		Days       int             `short:"d" long:"days" description:"Number of days to report, ending today" default:"7"`
+		End        string          `short:"e" long:"end" description:"Last day to report, YYYY-MM-DD (defaults to today)"`
+		Solar      bool            `short:"s" long:"solar" description:"Add grid import/export, self-consumed solar, self-sufficiency and self-consumption columns"`
+		Logging    logging.Options `group:"Logging Options"`
+	}
+	_, err := flags.Parse(&opts)
+	if err != nil {
+		// go-flags has already printed the error or help message
+		if flags.WroteHelp(err) {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+
+	logger, err := opts.Logging.New()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Load Config
+	cfg, err := config.LoadConfig(opts.ConfigFile, true)
+	fatalOnErr(logger, "Loading config", err)
+	if cfg.SQLite.File == "" {
+		fatalOnErr(logger, "Loading config", fmt.Errorf("no SQLite file configured"))
+	}
+
+	location, err := time.LoadLocation(cfg.Sense.Credentials.TimeZone)
+	fatalOnErr(logger, "Loading time zone", err)
+
+	// Report on whole local days
+	now := time.Now().In(location)
+	last := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	if opts.End != "" {
+		last, err = time.ParseInLocation("2006-01-02", opts.End, location)
+		fatalOnErr(logger, "Parsing end date", err)
+	}
+	start := last.AddDate(0, 0, 1-opts.Days)
+	end := last.AddDate(0, 0, 1)
+
+	filename, err := homedir.Expand(cfg.SQLite.File)
+	fatalOnErr(logger, "Expanding SQLite file", err)
+	db, err := sqlite.Open(filename, cfg.Sense.Credentials.MonitorID)
+	fatalOnErr(logger, "Opening SQLite", err)
+	defer db.Close()
+
+	// DAY scale trend records are per hour
+	days, err := db.DailyUsage(context.Background(), cfg.InfluxDB.Day.Measurement, location, start, end)
+	fatalOnErr(logger, "Reading daily usage", err)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(w, "Date\tConsumption\tProduction\tNet\t")
+	if opts.Solar {
+		fmt.Fprint(w, "Import\tExport\tSelf-consumed\tSelf-sufficiency\tSelf-consumption\t")
+	}
+	fmt.Fprintln(w)
+	var total sqlite.DailyUsage
+	for _, day := range days {
+		printUsage(w, day.Date.Format("2006-01-02"), day, opts.Solar)
+		total.Consumption += day.Consumption
+		total.Production += day.Production
+		total.Net += day.Net
+		total.Solar = total.Solar.Add(day.Solar)
+	}
+	printUsage(w, "Total (kWh)", total, opts.Solar)
+	w.Flush()
+}
+
+// Print one row of the report
+func printUsage(w io.Writer, label string, usage sqlite.DailyUsage, solar bool) {
+	fmt.Fprintf(w, "%s\t%.2f\t%.2f\t%.2f\t", label, usage.Consumption, usage.Production, usage.Net)
+	if solar {
+		fmt.Fprintf(w, "%.2f\t%.2f\t%.2f\t%.0f%%\t%.0f%%\t", usage.Solar.GridImport, usage.Solar.GridExport,
+			usage.Solar.SelfConsumed, usage.Solar.SelfSufficiency()*100, usage.Solar.SelfConsumption()*100)
+	}
+	fmt.Fprintln(w)
+}
+
+func fatalOnErr(logger *slog.Logger, msg string, err error) {
+	if err != nil {
+		logging.Fatal(logger, msg, err)
+	}
+}
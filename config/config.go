@@ -6,6 +6,7 @@ package config
 
 import (
 	"io/ioutil"
+	"time"
 
 	"github.com/david-lutz/sense_logger/credentials"
 	"github.com/mitchellh/go-homedir"
@@ -27,34 +28,277 @@ type MQTTConfig struct {
 	Topic    string `toml:"topic"`
 }
 
-// InfluxServer holds database connection parameters
+// EnergyConfig holds options for integrating realtime power into energy totals
+type EnergyConfig struct {
+	Enabled  bool          `toml:"enabled"`
+	MaxGap   time.Duration `toml:"max_gap"`  // Longest interval between samples that will be integrated
+	Interval time.Duration `toml:"interval"` // How often running totals are published
+	Topic    string        `toml:"topic"`    // MQTT topic for running totals, optional
+}
+
+// HTTPConfig holds options for the realtime logger's embedded HTTP server
+type HTTPConfig struct {
+	Listen        string        `toml:"listen"`          // Address to listen on, i.e. ":8080", empty disables the server
+	MaxMessageAge time.Duration `toml:"max_message_age"` // /healthz fails if no realtime message arrives within this time
+	API           bool          `toml:"api"`             // Serve /realtime/latest, /realtime/stream and /trends
+	TrendCacheTTL time.Duration `toml:"trend_cache_ttl"` // How long /trends reuses a Sense response
+}
+
+// BroadcastConfig holds options for re-broadcasting the realtime feed to local websocket
+// clients, served by the embedded HTTP server
+type BroadcastConfig struct {
+	Path         string        `toml:"path"`          // Websocket endpoint, i.e. "/realtime/ws", empty disables re-broadcasting
+	Raw          bool          `toml:"raw"`           // Send raw Sense frames instead of RealTime JSON
+	ClientBuffer int           `toml:"client_buffer"` // Messages buffered per client, clients that fall further behind are disconnected
+	WriteTimeout time.Duration `toml:"write_timeout"` // Clients that take longer to accept a message are disconnected
+}
+
+// PowerQualityRule is one power quality alert rule.  Type is "sag" or "swell" (leg voltage
+// below or above Threshold), "imbalance" (difference between the leg voltages above
+// Threshold) or "frequency" (deviation from Nominal above Threshold).  An alert is raised
+// once the threshold has been crossed for Duration, and cleared once the value has been back
+// past Clear for Duration.  Clear defaults to Threshold, set it further from the threshold
+// for hysteresis.
+type PowerQualityRule struct {
+	Name      string        `toml:"name"`
+	Type      string        `toml:"type"`
+	Leg       int           `toml:"leg"` // 1 or 2, 0 checks both legs
+	Threshold float64       `toml:"threshold"`
+	Clear     float64       `toml:"clear"`
+	Nominal   float64       `toml:"nominal"` // Nominal frequency, defaults to 60Hz
+	Duration  time.Duration `toml:"duration"`
+}
+
+// PowerQualityConfig holds the power quality alert rules and where alerts are sent, events
+// are also written to the InfluxDB PowerQuality measurement
+type PowerQualityConfig struct {
+	Rules    []PowerQualityRule `toml:"Rules"`    // No rules disables power quality monitoring
+	Topic    string             `toml:"topic"`    // MQTT topic for alerts, optional
+	Webhooks []string           `toml:"webhooks"` // URLs alerts are POSTed to as JSON
+}
+
+// AlertRule is a threshold alert over realtime or trend fields, see the alert package for
+// the expression syntax and field names
+type AlertRule struct {
+	Name       string        `toml:"name"`
+	Source     string        `toml:"source"`     // "realtime" (default) or "trend"
+	Expression string        `toml:"expression"` // i.e. "consumption > 8000"
+	Duration   time.Duration `toml:"duration"`   // How long the expression must hold before alerting
+	From       string        `toml:"from"`       // Optional "HH:MM" time of day window, in the monitor's time zone
+	To         string        `toml:"to"`
+	Scale      string        `toml:"scale"` // Trend rules only check this scale, empty checks every scale
+}
+
+// SMTPConfig holds email notification options, an empty Host disables email
+type SMTPConfig struct {
+	Host     string   `toml:"host"`
+	Port     int      `toml:"port"`
+	Username string   `toml:"username"`
+	Password string   `toml:"password"`
+	From     string   `toml:"from"`
+	To       []string `toml:"to"`
+}
+
+// NtfyConfig holds ntfy notification options, an empty URL disables ntfy
+type NtfyConfig struct {
+	URL      string `toml:"url"` // Topic URL, i.e. "https://ntfy.sh/mytopic"
+	Token    string `toml:"token"`
+	Priority string `toml:"priority"`
+	Tags     string `toml:"tags"`
+}
+
+// AlertsConfig holds threshold alert rules and where their notifications are sent
+type AlertsConfig struct {
+	Rules    []AlertRule `toml:"Rules"`
+	Webhooks []string    `toml:"webhooks"` // URLs alerts are POSTed to as JSON
+	SMTP     SMTPConfig  `toml:"SMTP"`
+	Ntfy     NtfyConfig  `toml:"Ntfy"`
+}
+
+// CarbonConfig holds the grid emission factor schedule in kg CO2 per kWh.  Factors from the
+// CSV file take precedence, then the hourly profile, then the static factor.
+type CarbonConfig struct {
+	Factor float64   `toml:"factor"` // Static factor
+	Hourly []float64 `toml:"hourly"` // 24 factors, one per local hour of the day
+	File   string    `toml:"file"`   // CSV of timestamp,factor rows, each factor applies until the next row
+}
+
+// SolarConfig holds the location (degrees, north and east positive) and layout of the solar
+// array.  Capacity enables clear-sky performance tracking.
+type SolarConfig struct {
+	Latitude  float64  `toml:"latitude"`
+	Longitude float64  `toml:"longitude"`
+	Capacity  float64  `toml:"capacity"` // DC capacity in kW
+	Tilt      float64  `toml:"tilt"`     // Panel tilt from horizontal, degrees
+	Azimuth   *float64 `toml:"azimuth"`  // Direction the panels face, degrees clockwise from north, south if unset
+	Derate    float64  `toml:"derate"`   // Fraction of DC output left after inverter and wiring losses
+}
+
+// Located returns true if the array's location is configured
+func (s SolarConfig) Located() bool {
+	return s.Latitude != 0 || s.Longitude != 0
+}
+
+// ProductionConfig holds the production cooking model, applied before the production
+// threshold.  Production outside sunrise to sunset (widened by Margin) is zeroed when the
+// [Solar] location is configured, and the idle reading is subtracted: either a fixed Baseline
+// or, with Learn, the median night time reading over the last Nights nights.
+type ProductionConfig struct {
+	Baseline  float64       `toml:"baseline"`   // Watts read with the inverters off
+	Learn     bool          `toml:"learn"`      // Learn the baseline from recent nights, needs the [Solar] location
+	Nights    int           `toml:"nights"`     // Nights to learn from
+	Margin    time.Duration `toml:"margin"`     // Widen the daylight window by this much on each side
+	StateFile string        `toml:"state_file"` // Keeps learned nights between runs, optional
+}
+
+// QueueConfig holds the size and drop policy ("drop-oldest", "drop-newest" or "block") of the
+// realtime publisher queues, Sinks holds per publisher overrides
+type QueueConfig struct {
+	Size   int                        `toml:"size"`
+	Policy string                     `toml:"policy"`
+	Sinks  map[string]SinkQueueConfig `toml:"Sinks"`
+}
+
+// SinkQueueConfig holds one publisher's queue size and drop policy, zero values keep the
+// [Queue] defaults
+type SinkQueueConfig struct {
+	Size   int    `toml:"size"`
+	Policy string `toml:"policy"`
+}
+
+// ForSink returns the queue config for a publisher, with any overrides applied
+func (q QueueConfig) ForSink(name string) SinkQueueConfig {
+	sinkCfg := SinkQueueConfig{Size: q.Size, Policy: q.Policy}
+	if override, ok := q.Sinks[name]; ok {
+		if override.Size > 0 {
+			sinkCfg.Size = override.Size
+		}
+		if override.Policy != "" {
+			sinkCfg.Policy = override.Policy
+		}
+	}
+	return sinkCfg
+}
+
+// PostgresConfig holds PostgreSQL connection options, tables are named after the InfluxDB
+// measurements
+type PostgresConfig struct {
+	URL           string        `toml:"url"`            // Connection string or URL, empty disables PostgreSQL
+	TimescaleDB   bool          `toml:"timescaledb"`    // Create TimescaleDB hypertables
+	BatchSize     int           `toml:"batch_size"`     // Realtime rows per COPY
+	FlushInterval time.Duration `toml:"flush_interval"` // Longest time realtime rows are held before writing
+}
+
+// SQLiteConfig holds options for the embedded SQLite store, tables are named after the
+// InfluxDB measurements except the device inventory
+type SQLiteConfig struct {
+	File            string        `toml:"file"`              // Database file, empty disables SQLite
+	RollupAfterDays int           `toml:"rollup_after_days"` // Realtime rows older than this are rolled up into per minute rows, 0 keeps them
+	BatchSize       int           `toml:"batch_size"`        // Realtime rows per transaction
+	FlushInterval   time.Duration `toml:"flush_interval"`    // Longest time realtime rows are held before writing
+	DevicesTable    string        `toml:"devices_table"`     // Device inventory table written by sense_devices
+}
+
+// DefaultDevicesTable is the SQLite device inventory table when none is configured
+const DefaultDevicesTable = "sense_devices"
+
+// DevicesTableName returns the device inventory table, DefaultDevicesTable if unset
+func (s SQLiteConfig) DevicesTableName() string {
+	if s.DevicesTable == "" {
+		return DefaultDevicesTable
+	}
+	return s.DevicesTable
+}
+
+// InfluxServer holds database connection parameters.  Version 2 (the default) uses org and
+// token, version 1 (InfluxDB 1.8+) uses username and password.
 type InfluxServer struct {
-	URL   string `toml:"url"`
-	Org   string `toml:"org"`
-	Token string `toml:"token"`
+	URL      string `toml:"url"`
+	Version  int    `toml:"version"`
+	Org      string `toml:"org"`
+	Token    string `toml:"token"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
+// IsV1 returns true when talking to an InfluxDB 1.x server
+func (s InfluxServer) IsV1() bool {
+	return s.Version == 1
+}
+
+// AuthToken returns the token for the client, 1.x servers take "username:password"
+func (s InfluxServer) AuthToken() string {
+	if s.IsV1() {
+		if s.Username == "" {
+			return ""
+		}
+		return s.Username + ":" + s.Password
+	}
+	return s.Token
+}
+
+// OrgName returns the organization for the client, 1.x servers don't have one
+func (s InfluxServer) OrgName() string {
+	if s.IsV1() {
+		return ""
+	}
+	return s.Org
 }
 
-// InfluxDBBatchConfig holds configuration for a batch of points
+// InfluxDBBatchConfig holds configuration for a batch of points.  For 1.x servers the bucket
+// is "database/retention_policy", built from Database and RetentionPolicy if they are set.
 type InfluxDBBatchConfig struct {
-	Bucket      string `toml:"bucket"`
-	Measurement string `toml:"measurement"`
+	Bucket          string `toml:"bucket"`
+	Database        string `toml:"database"`
+	RetentionPolicy string `toml:"retention_policy"`
+	Measurement     string `toml:"measurement"`
+}
+
+// BucketName returns the bucket to read and write on the given server
+func (b InfluxDBBatchConfig) BucketName(server InfluxServer) string {
+	if server.IsV1() && b.Database != "" {
+		return b.Database + "/" + b.RetentionPolicy
+	}
+	return b.Bucket
 }
 
 // InfluxDBConfig holds server and measurement parameters
 type InfluxDBConfig struct {
-	Server   InfluxServer        `toml:"Server"`
-	Hour     InfluxDBBatchConfig `toml:"Hour"`
-	Day      InfluxDBBatchConfig `toml:"Day"`
-	Month    InfluxDBBatchConfig `toml:"Month"`
-	Year     InfluxDBBatchConfig `toml:"Year"`
-	RealTime InfluxDBBatchConfig `toml:"RealTime"`
+	Server       InfluxServer        `toml:"Server"`
+	Hour         InfluxDBBatchConfig `toml:"Hour"`
+	Day          InfluxDBBatchConfig `toml:"Day"`
+	Month        InfluxDBBatchConfig `toml:"Month"`
+	Year         InfluxDBBatchConfig `toml:"Year"`
+	RealTime     InfluxDBBatchConfig `toml:"RealTime"`
+	Energy       InfluxDBBatchConfig `toml:"Energy"`
+	Reconcile    InfluxDBBatchConfig `toml:"Reconcile"`
+	PowerQuality InfluxDBBatchConfig `toml:"PowerQuality"`
+	Carbon       InfluxDBBatchConfig `toml:"Carbon"`
+	Revisions    InfluxDBBatchConfig `toml:"Revisions"`
+	Devices      InfluxDBBatchConfig `toml:"Devices"`
+	Inventory    InfluxDBBatchConfig `toml:"Inventory"`
+	// Rollups of the per minute data, kept apart from Sense's own totals
+	RollupDay   InfluxDBBatchConfig `toml:"RollupDay"`
+	RollupMonth InfluxDBBatchConfig `toml:"RollupMonth"`
+	RollupYear  InfluxDBBatchConfig `toml:"RollupYear"`
 }
 
 // Config is the structure of the external configuration file
 type Config struct {
-	Sense    SenseConfig    `toml:"Sense"`
-	MQTT     MQTTConfig     `toml:"MQTT"`
-	InfluxDB InfluxDBConfig `toml:"InfluxDB"`
+	Sense        SenseConfig        `toml:"Sense"`
+	MQTT         MQTTConfig         `toml:"MQTT"`
+	Energy       EnergyConfig       `toml:"Energy"`
+	HTTP         HTTPConfig         `toml:"HTTP"`
+	Broadcast    BroadcastConfig    `toml:"Broadcast"`
+	PowerQuality PowerQualityConfig `toml:"PowerQuality"`
+	Alerts       AlertsConfig       `toml:"Alerts"`
+	Carbon       CarbonConfig       `toml:"Carbon"`
+	Solar        SolarConfig        `toml:"Solar"`
+	Production   ProductionConfig   `toml:"Production"`
+	Queue        QueueConfig        `toml:"Queue"`
+	InfluxDB     InfluxDBConfig     `toml:"InfluxDB"`
+	Postgres     PostgresConfig     `toml:"Postgres"`
+	SQLite       SQLiteConfig       `toml:"SQLite"`
 }
 
 // LoadConfig loads config from file and optionally loads Sense credentials
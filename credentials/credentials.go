@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"time"
@@ -23,8 +23,9 @@ type Credentials struct {
 }
 
 // WriteCreds saves the Credentials to a file
-func WriteCreds(credentials Credentials, filename string) error {
-	log.Println("WriteCreds", credentials)
+func WriteCreds(credentials Credentials, filename string, logger *slog.Logger) error {
+	logger.Debug("Writing credentials", "file", filename, "monitorID", credentials.MonitorID,
+		"timeZone", credentials.TimeZone, "timestamp", credentials.Timestamp)
 
 	data, err := json.MarshalIndent(credentials, "", "  ")
 	if err != nil {
@@ -33,7 +34,9 @@ func WriteCreds(credentials Credentials, filename string) error {
 
 	data = append(data, 10)                      // Add newline character to make file prettier
 	err = ioutil.WriteFile(filename, data, 0600) // Make file permissions read+write for user only
-	log.Println("write err:", err)
+	if err != nil {
+		logger.Error("Writing credentials", "file", filename, "err", err)
+	}
 
 	return err
 }
@@ -51,7 +54,8 @@ func ReadCreds(filename string) (Credentials, error) {
 }
 
 // FetchCredentials gets bearer token and monitor credentials from Sense Web Service
-func FetchCredentials(email, password string) (Credentials, error) {
+func FetchCredentials(email, password string, logger *slog.Logger) (Credentials, error) {
+	logger.Debug("Authenticating", "url", authenticateURL, "email", email)
 	res, err := http.PostForm(authenticateURL,
 		url.Values{
 			"email":    {email},
@@ -62,6 +66,7 @@ func FetchCredentials(email, password string) (Credentials, error) {
 	}
 	defer res.Body.Close()
 
+	logger.Debug("Authentication response", "status", res.Status)
 	if res.StatusCode != 200 {
 		err = fmt.Errorf("StatusCode: %d, Status: %s", res.StatusCode, res.Status)
 		return Credentials{}, err
@@ -0,0 +1,53 @@
+package logging
+
+/*
+ * This file sets up the structured logger shared by all of the commands.
+ */
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Options are the logging command line flags, embed them in a command's options as a group
+type Options struct {
+	Level   string `long:"log-level" description:"Log level" choice:"debug" choice:"info" choice:"warn" choice:"error" default:"info"`
+	Format  string `long:"log-format" description:"Log output format" choice:"text" choice:"json" default:"text"`
+	Verbose bool   `short:"v" long:"verbose" description:"Verbose mode (same as --log-level=debug)"`
+}
+
+// New creates a logger writing to stderr
+func (o Options) New() (*slog.Logger, error) {
+	return o.NewWriter(os.Stderr)
+}
+
+// NewWriter creates a logger writing to w
+func (o Options) NewWriter(w io.Writer) (*slog.Logger, error) {
+	level := slog.LevelInfo
+	if o.Level != "" {
+		if err := level.UnmarshalText([]byte(o.Level)); err != nil {
+			return nil, err
+		}
+	}
+	if o.Verbose {
+		level = slog.LevelDebug
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(o.Format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format: %s", o.Format)
+}
+
+// Fatal logs an error and exits
+func Fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "err", err)
+	os.Exit(1)
+}
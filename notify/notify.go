@@ -0,0 +1,194 @@
+package notify
+
+/*
+ * This file delivers alert notifications.  Webhooks receive the alert as a JSON POST body,
+ * SMTP sends a plain text email and ntfy style endpoints receive the message as the POST
+ * body with the title and priority in headers.
+ */
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Timeout for a single notification
+const Timeout = 10 * time.Second
+
+var client = &http.Client{Timeout: Timeout}
+
+// Notification is one alert message, Payload is what webhooks receive
+type Notification struct {
+	Title   string
+	Message string
+	Payload interface{}
+}
+
+// Notifier delivers notifications
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+	String() string // For logging
+}
+
+// Webhook POSTs the payload to the URL as JSON, any 2xx response is success
+func Webhook(ctx context.Context, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return do(req)
+}
+
+// Send the request, any 2xx response is success
+func do(req *http.Request) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: status code error: %d %s", req.URL.Redacted(), res.StatusCode, res.Status)
+	}
+	return nil
+}
+
+// WebhookNotifier POSTs the notification payload as JSON
+type WebhookNotifier struct {
+	URL string
+}
+
+// Notify implements Notifier
+func (w WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	return Webhook(ctx, w.URL, n.Payload)
+}
+
+func (w WebhookNotifier) String() string {
+	return "webhook " + w.URL
+}
+
+// NtfyNotifier POSTs the message to an ntfy style topic URL, i.e. https://ntfy.sh/mytopic
+type NtfyNotifier struct {
+	URL      string
+	Token    string // Optional access token
+	Priority string // Optional, "min", "low", "default", "high" or "urgent"
+	Tags     string // Optional, comma separated
+}
+
+// Notify implements Notifier
+func (n NtfyNotifier) Notify(ctx context.Context, notification Notification) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, strings.NewReader(notification.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", notification.Title)
+	if n.Priority != "" {
+		req.Header.Set("Priority", n.Priority)
+	}
+	if n.Tags != "" {
+		req.Header.Set("Tags", n.Tags)
+	}
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	return do(req)
+}
+
+func (n NtfyNotifier) String() string {
+	return "ntfy " + n.URL
+}
+
+// SMTPNotifier emails the message.  STARTTLS is used when the server offers it, and the
+// username and password are optional.
+type SMTPNotifier struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// Notify implements Notifier
+func (s SMTPNotifier) Notify(ctx context.Context, n Notification) error {
+	addr := net.JoinHostPort(s.Host, fmt.Sprint(s.Port))
+	dialer := net.Dialer{Timeout: Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	for _, to := range s.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(s.message(n)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// RFC 5322 message with CRLF line endings
+func (s SMTPNotifier) message(n Notification) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", n.Title)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(strings.TrimRight(n.Message, "\n"), "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func (s SMTPNotifier) String() string {
+	return "smtp " + net.JoinHostPort(s.Host, fmt.Sprint(s.Port))
+}
@@ -0,0 +1,197 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// What the fake SMTP server received in one session
+type smtpSession struct {
+	auth  string // Decoded AUTH PLAIN credentials
+	from  string
+	to    []string
+	data  string
+	quit  bool
+	error string // Protocol error seen by the server
+}
+
+// Start a minimal SMTP server on localhost that accepts a single session.  Recipients in
+// reject are refused with a 550.
+func fakeSMTP(t *testing.T, reject map[string]bool) (host string, port int, sessions <-chan smtpSession) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	ch := make(chan smtpSession, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		ch <- serveSMTP(conn, reject)
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, ch
+}
+
+func serveSMTP(conn net.Conn, reject map[string]bool) smtpSession {
+	var session smtpSession
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			conn.Write([]byte(line + "\r\n"))
+		}
+	}
+
+	reply("220 localhost fake SMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return session
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO":
+			reply("250-localhost", "250 AUTH PLAIN")
+		case "AUTH":
+			fields := strings.Fields(line)
+			decoded, err := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			if err != nil {
+				session.error = err.Error()
+				reply("501 bad encoding")
+				continue
+			}
+			session.auth = string(decoded)
+			reply("235 authenticated")
+		case "MAIL":
+			session.from = strings.TrimSuffix(strings.TrimPrefix(line, "MAIL FROM:<"), ">")
+			reply("250 ok")
+		case "RCPT":
+			to := strings.TrimSuffix(strings.TrimPrefix(line, "RCPT TO:<"), ">")
+			if reject[to] {
+				reply("550 no such user")
+				continue
+			}
+			session.to = append(session.to, to)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return session
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			session.data = data.String()
+			reply("250 queued")
+		case "QUIT":
+			session.quit = true
+			reply("221 bye")
+			return session
+		default:
+			session.error = "unexpected " + line
+			reply("500 unrecognised command")
+		}
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	host, port, sessions := fakeSMTP(t, nil)
+	notifier := SMTPNotifier{
+		Host:     host,
+		Port:     port,
+		Username: "user",
+		Password: "secret",
+		From:     "sense@example.com",
+		To:       []string{"a@example.com", "b@example.com"},
+	}
+
+	err := notifier.Notify(context.Background(), Notification{
+		Title:   "Sense alert: high load",
+		Message: "consumption > 8000 since now\nconsumption = 9000\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := <-sessions
+	if session.error != "" {
+		t.Fatal(session.error)
+	}
+	if session.auth != "\x00user\x00secret" {
+		t.Errorf("auth = %q", session.auth)
+	}
+	if session.from != notifier.From {
+		t.Errorf("from = %q, want %q", session.from, notifier.From)
+	}
+	if strings.Join(session.to, ",") != "a@example.com,b@example.com" {
+		t.Errorf("to = %v", session.to)
+	}
+	if !session.quit {
+		t.Error("session didn't QUIT")
+	}
+	for _, want := range []string{
+		"From: sense@example.com\r\n",
+		"To: a@example.com, b@example.com\r\n",
+		"Subject: Sense alert: high load\r\n",
+		"\r\n\r\nconsumption > 8000 since now\r\nconsumption = 9000\r\n",
+	} {
+		if !strings.Contains(session.data, want) {
+			t.Errorf("message missing %q:\n%s", want, session.data)
+		}
+	}
+}
+
+func TestSMTPNotifierRejectedRecipient(t *testing.T) {
+	host, port, sessions := fakeSMTP(t, map[string]bool{"nobody@example.com": true})
+	notifier := SMTPNotifier{
+		Host: host,
+		Port: port,
+		From: "sense@example.com",
+		To:   []string{"nobody@example.com"},
+	}
+
+	err := notifier.Notify(context.Background(), Notification{Title: "title", Message: "message"})
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Fatalf("err = %v, want a 550 error", err)
+	}
+	if session := <-sessions; session.data != "" {
+		t.Errorf("message sent despite rejected recipient:\n%s", session.data)
+	}
+}
+
+func TestSMTPNotifierUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	notifier := SMTPNotifier{Host: "127.0.0.1", Port: port, From: "sense@example.com", To: []string{"a@example.com"}}
+	if err := notifier.Notify(context.Background(), Notification{}); err == nil {
+		t.Fatal("expected a connection error")
+	}
+	if got, want := notifier.String(), "smtp 127.0.0.1:"+strconv.Itoa(port); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,156 @@
+package postgres
+
+/*
+ * This file writes Sense trend and realtime data to PostgreSQL, with optional TimescaleDB
+ * hypertables.  Rows are loaded with COPY into a staging table and then upserted, so writing
+ * the same window twice doesn't duplicate rows.
+ */
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/david-lutz/sense_logger/store"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Store writes rows for a single Sense monitor
+type Store struct {
+	pool      *pgxpool.Pool
+	monitorID int64
+	timescale bool
+
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+// Connect opens a connection pool, url is a PostgreSQL connection string or URL
+func Connect(ctx context.Context, url string, monitorID int64, timescale bool) (*Store, error) {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return &Store{
+		pool:      pool,
+		monitorID: monitorID,
+		timescale: timescale,
+		created:   make(map[string]bool),
+	}, nil
+}
+
+// Close the connection pool
+func (s *Store) Close() {
+	s.pool.Close()
+}
+
+// WriteTrend upserts trend rows into the table, creating it if needed
+func (s *Store) WriteTrend(ctx context.Context, table string, rows []store.TrendRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := s.ensureTable(ctx, table, store.TrendColumns); err != nil {
+		return err
+	}
+
+	values := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		values[i] = row.Values(s.monitorID, row.Time)
+	}
+	return s.upsert(ctx, table, store.TrendColumns, values)
+}
+
+// WriteRealTime upserts realtime rows into the table, creating it if needed
+func (s *Store) WriteRealTime(ctx context.Context, table string, rows []store.RealTimeRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := s.ensureTable(ctx, table, store.RealTimeColumns); err != nil {
+		return err
+	}
+
+	values := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		values[i] = row.Values(s.monitorID, row.Time)
+	}
+	return s.upsert(ctx, table, store.RealTimeColumns, values)
+}
+
+// Create the table (and hypertable) the first time we write to it.  The first two columns
+// are always time and monitor_id and form the primary key, the rest are doubles.
+func (s *Store) ensureTable(ctx context.Context, table string, columns []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.created[table] {
+		return nil
+	}
+
+	defs := []string{"time timestamptz NOT NULL", "monitor_id bigint NOT NULL"}
+	for _, column := range columns[2:] {
+		defs = append(defs, column+" double precision")
+	}
+	defs = append(defs, "PRIMARY KEY (monitor_id, time)")
+
+	sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n)",
+		pgx.Identifier{table}.Sanitize(), strings.Join(defs, ",\n\t"))
+	if _, err := s.pool.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("creating table %s: %w", table, err)
+	}
+
+	if s.timescale {
+		_, err := s.pool.Exec(ctx, "SELECT create_hypertable($1::regclass, 'time', if_not_exists => TRUE)",
+			pgx.Identifier{table}.Sanitize())
+		if err != nil {
+			return fmt.Errorf("creating hypertable %s: %w", table, err)
+		}
+	}
+
+	s.created[table] = true
+	return nil
+}
+
+// COPY the rows into a temporary staging table, then insert them into the real table,
+// replacing any existing rows with the same time and monitor
+func (s *Store) upsert(ctx context.Context, table string, columns []string, values [][]interface{}) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	ident := pgx.Identifier{table}.Sanitize()
+	stage := "stage_" + strings.ReplaceAll(strings.ReplaceAll(table, ".", "_"), "\"", "")
+	stageIdent := pgx.Identifier{stage}.Sanitize()
+
+	_, err = tx.Exec(ctx, fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP", stageIdent, ident))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{stage}, columns, pgx.CopyFromRows(values))
+	if err != nil {
+		return err
+	}
+
+	updates := make([]string, 0, len(columns)-2)
+	for _, column := range columns[2:] {
+		updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+	}
+	// DISTINCT ON because a batch can't update the same row twice
+	_, err = tx.Exec(ctx, fmt.Sprintf(
+		"INSERT INTO %s (%s) SELECT DISTINCT ON (monitor_id, time) %s FROM %s ORDER BY monitor_id, time "+
+			"ON CONFLICT (monitor_id, time) DO UPDATE SET %s",
+		ident, strings.Join(columns, ", "), strings.Join(columns, ", "), stageIdent, strings.Join(updates, ", ")))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,39 @@
+package sense
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+
+	"github.com/david-lutz/sense_logger/credentials"
+)
+
+// GET a Sense API url with the "Authorization" header set to the credential token, returning
+// the response body
+func apiGet(creds credentials.Credentials, url string, logger *slog.Logger) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("bearer %s", creds.Token))
+	logger.Debug("API request", "url", url)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("API response", "status", res.Status, "contentLength", res.ContentLength)
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		if logger.Enabled(context.Background(), slog.LevelDebug) {
+			p := make([]byte, 1024)
+			n, _ := res.Body.Read(p)
+			logger.Debug("API error response", "body", string(p[:n]))
+		}
+		return nil, fmt.Errorf("status code error: %d %s", res.StatusCode, res.Status)
+	}
+
+	// Slurp in the entire response body
+	return ioutil.ReadAll(res.Body)
+}
@@ -0,0 +1,59 @@
+package sense
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/david-lutz/sense_logger/credentials"
+)
+
+const devicesURL = "https://api.sense.com/apiservice/api/v1/app/monitors/%d/devices"
+
+// Device is one device Sense has detected (or the user has added) on the monitor.  Tags
+// hold Sense's metadata, mostly strings with a few lists and flags.
+type Device struct {
+	ID    string                 `json:"id"`
+	Name  string                 `json:"name"`
+	Icon  string                 `json:"icon"`
+	Make  string                 `json:"make"`
+	Model string                 `json:"model"`
+	Tags  map[string]interface{} `json:"tags"`
+}
+
+// Type returns the device type, as set by the user or else as detected by Sense
+func (d Device) Type() string {
+	for _, tag := range []string{"UserDeviceType", "DefaultUserDeviceType"} {
+		if value, ok := d.Tags[tag].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// StringTags returns the tags with string values
+func (d Device) StringTags() map[string]string {
+	tags := make(map[string]string, len(d.Tags))
+	for name, value := range d.Tags {
+		if str, ok := value.(string); ok {
+			tags[name] = str
+		}
+	}
+	return tags
+}
+
+// GetDevices returns the monitor's devices sorted by name
+func GetDevices(creds credentials.Credentials, logger *slog.Logger) ([]Device, error) {
+	body, err := apiGet(creds, fmt.Sprintf(devicesURL, creds.MonitorID), logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []Device
+	if err := json.Unmarshal(body, &devices); err != nil {
+		return nil, fmt.Errorf("decoding devices response: %w", err)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices, nil
+}
@@ -0,0 +1,180 @@
+package sense
+
+import (
+	"fmt"
+	"time"
+)
+
+// Period "enum" for energy accumulation windows
+type Period int
+
+// Period "enum" values
+const (
+	PerMinute Period = iota
+	PerHour
+	PerDay
+)
+
+var periods = [...]string{
+	"minute",
+	"hour",
+	"day",
+}
+
+func (p Period) String() string {
+	return periods[p]
+}
+
+// MarshalText lets periods appear by name in JSON output
+func (p Period) MarshalText() ([]byte, error) {
+	if p < PerMinute || p > PerDay {
+		return nil, fmt.Errorf("invalid period: %d", p)
+	}
+	return []byte(p.String()), nil
+}
+
+// EnergyTotals holds the energy (in Wh) accumulated over one period
+type EnergyTotals struct {
+	Period      Period        `json:"period"`
+	Start       time.Time     `json:"start"`
+	End         time.Time     `json:"end"`
+	Consumption float64       `json:"consumption"`
+	Production  float64       `json:"production"`
+	Net         float64       `json:"net"`
+	GridImport  float64       `json:"gridImport"`
+	GridExport  float64       `json:"gridExport"`
+	Coverage    time.Duration `json:"coverage"` // How much of the period was backed by realtime samples
+}
+
+// Solar returns the grid and self-consumption split, netted per realtime interval
+func (t EnergyTotals) Solar() SolarSplit {
+	return SolarSplit{
+		GridImport:   t.GridImport,
+		GridExport:   t.GridExport,
+		SelfConsumed: t.Production - t.GridExport,
+	}
+}
+
+// CoverageRatio returns the fraction of the period that was backed by realtime samples
+func (t EnergyTotals) CoverageRatio() float64 {
+	length := t.End.Sub(t.Start)
+	if length <= 0 {
+		return 0
+	}
+	return float64(t.Coverage) / float64(length)
+}
+
+// EnergyIntegrator accumulates RealTime power readings into per minute, hour and day energy
+// totals.  Consecutive samples are integrated with the trapezoid rule, intervals longer than
+// the max gap (i.e. websocket reconnects) are skipped rather than guessed at.
+type EnergyIntegrator struct {
+	location *time.Location
+	maxGap   time.Duration
+	last     RealTime
+	haveLast bool
+	totals   [3]EnergyTotals
+}
+
+// NewEnergyIntegrator creates an integrator with period boundaries in the given location
+func NewEnergyIntegrator(location *time.Location, maxGap time.Duration) *EnergyIntegrator {
+	return &EnergyIntegrator{
+		location: location,
+		maxGap:   maxGap,
+	}
+}
+
+// Reset forgets the previous sample, the next sample will start a new interval
+func (e *EnergyIntegrator) Reset() {
+	e.haveLast = false
+}
+
+// Totals returns the running totals for the current minute, hour and day
+func (e *EnergyIntegrator) Totals() []EnergyTotals {
+	if e.totals[PerMinute].Start.IsZero() {
+		return nil
+	}
+	totals := make([]EnergyTotals, len(e.totals))
+	copy(totals, e.totals[:])
+	return totals
+}
+
+// Add integrates the interval since the previous sample and returns the totals for any
+// periods that were completed along the way.
+func (e *EnergyIntegrator) Add(realtime RealTime) []EnergyTotals {
+	var completed []EnergyTotals
+
+	// Duplicate or out of order samples are ignored
+	if e.haveLast && !realtime.Timestamp.After(e.last.Timestamp) {
+		return nil
+	}
+
+	// Only integrate if the previous sample is recent enough to trust
+	if e.haveLast && realtime.Timestamp.Sub(e.last.Timestamp) <= e.maxGap {
+		consumption := (e.last.Consumption + realtime.Consumption) / 2
+		production := (e.last.Production + realtime.Production) / 2
+		split := Split(consumption, production)
+
+		// Split the interval at period boundaries, minute boundaries are always the
+		// first boundary reached so they set the segment length.
+		cur := e.last.Timestamp
+		for cur.Before(realtime.Timestamp) {
+			completed = append(completed, e.roll(cur)...)
+			end := e.totals[PerMinute].End
+			if realtime.Timestamp.Before(end) {
+				end = realtime.Timestamp
+			}
+			length := end.Sub(cur)
+			hours := length.Hours()
+			for i := range e.totals {
+				e.totals[i].Consumption += consumption * hours
+				e.totals[i].Production += production * hours
+				e.totals[i].Net += (consumption - production) * hours
+				e.totals[i].GridImport += split.GridImport * hours
+				e.totals[i].GridExport += split.GridExport * hours
+				e.totals[i].Coverage += length
+			}
+			cur = end
+		}
+	}
+
+	completed = append(completed, e.roll(realtime.Timestamp)...)
+	e.last = realtime
+	e.haveLast = true
+
+	return completed
+}
+
+// Close out any periods that end at or before t, starting new (empty) periods containing t
+func (e *EnergyIntegrator) roll(t time.Time) []EnergyTotals {
+	var completed []EnergyTotals
+	for i := range e.totals {
+		p := Period(i)
+		if !e.totals[p].Start.IsZero() && t.Before(e.totals[p].End) {
+			continue
+		}
+		if !e.totals[p].Start.IsZero() {
+			completed = append(completed, e.totals[p])
+		}
+		start, end := e.periodBounds(p, t)
+		e.totals[p] = EnergyTotals{Period: p, Start: start, End: end}
+	}
+	return completed
+}
+
+// Start and end of the period containing t, day boundaries follow the local calendar so DST
+// days are 23 or 25 hours long.
+func (e *EnergyIntegrator) periodBounds(p Period, t time.Time) (time.Time, time.Time) {
+	local := t.In(e.location)
+	switch p {
+	case PerMinute:
+		start := local.Add(-time.Duration(local.Second())*time.Second - time.Duration(local.Nanosecond()))
+		return start, start.Add(time.Minute)
+	case PerHour:
+		start := local.Add(-time.Duration(local.Minute())*time.Minute -
+			time.Duration(local.Second())*time.Second - time.Duration(local.Nanosecond()))
+		return start, start.Add(time.Hour)
+	default:
+		start := beginningOfDay(local, e.location)
+		return start, time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, e.location)
+	}
+}
@@ -0,0 +1,170 @@
+package sense
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Energy values are sums of float products, compare them to within a microwatt hour
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func sample(t time.Time, consumption, production float64) RealTime {
+	return RealTime{Timestamp: t, Consumption: consumption, Production: production}
+}
+
+func TestEnergyIntegratorTrapezoid(t *testing.T) {
+	start := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	e := NewEnergyIntegrator(time.UTC, 10*time.Second)
+	if e.Totals() != nil {
+		t.Fatal("totals before the first sample")
+	}
+
+	// Power ramps from 1000W to 2000W over 10s, then holds at 2000W for 5s
+	e.Add(sample(start, 1000, 0))
+	e.Add(sample(start.Add(10*time.Second), 2000, 0))
+	e.Add(sample(start.Add(15*time.Second), 2000, 0))
+
+	totals := e.Totals()
+	if len(totals) != 3 {
+		t.Fatalf("got %d totals, want 3", len(totals))
+	}
+	want := 1500*10.0/3600 + 2000*5.0/3600
+	for _, total := range totals {
+		if !near(total.Consumption, want) || !near(total.Net, want) || !near(total.GridImport, want) {
+			t.Errorf("%s: consumption %g net %g import %g, want %g", total.Period, total.Consumption, total.Net, total.GridImport, want)
+		}
+		if total.Coverage != 15*time.Second {
+			t.Errorf("%s: coverage %s, want 15s", total.Period, total.Coverage)
+		}
+	}
+	if got := totals[PerMinute].CoverageRatio(); !near(got, 0.25) {
+		t.Errorf("minute coverage ratio %g, want 0.25", got)
+	}
+}
+
+func TestEnergyIntegratorGridSplit(t *testing.T) {
+	start := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	e := NewEnergyIntegrator(time.UTC, time.Minute)
+
+	// Exporting 2000W for 36s (20Wh) then importing 2000W for 36s (20Wh), with a 1s ramp
+	// between that nets to zero.  Netting the whole minute would hide both.
+	e.Add(sample(start, 1000, 3000))
+	e.Add(sample(start.Add(36*time.Second), 1000, 3000))
+	e.Add(sample(start.Add(37*time.Second), 3000, 1000))
+	e.Add(sample(start.Add(73*time.Second), 3000, 1000))
+
+	hour := e.Totals()[PerHour]
+	solar := hour.Solar()
+	if !near(hour.GridExport, 20) || !near(hour.GridImport, 20) {
+		t.Errorf("export %g import %g, want 20 and 20", hour.GridExport, hour.GridImport)
+	}
+	if !near(hour.Net, 0) || !near(hour.Consumption, hour.Production) {
+		t.Errorf("net %g, consumption %g, production %g, want net 0", hour.Net, hour.Consumption, hour.Production)
+	}
+	if !near(solar.SelfConsumed, hour.Production-20) {
+		t.Errorf("self consumed %g, want production %g less export", solar.SelfConsumed, hour.Production)
+	}
+}
+
+func TestEnergyIntegratorMinuteBoundary(t *testing.T) {
+	start := time.Date(2026, 7, 1, 12, 59, 50, 0, time.UTC)
+	e := NewEnergyIntegrator(time.UTC, 30*time.Second)
+
+	if completed := e.Add(sample(start, 3600, 0)); len(completed) != 0 {
+		t.Fatalf("first sample completed %d periods", len(completed))
+	}
+
+	// 20s at 3600W straddling 13:00, 10s (10Wh) falls in each minute and hour
+	completed := e.Add(sample(start.Add(20*time.Second), 3600, 0))
+	if len(completed) != 2 || completed[0].Period != PerMinute || completed[1].Period != PerHour {
+		t.Fatalf("completed %+v, want the minute and the hour", completed)
+	}
+	for _, total := range completed {
+		if !near(total.Consumption, 10) || total.Coverage != 10*time.Second {
+			t.Errorf("%s: %g Wh over %s, want 10 Wh over 10s", total.Period, total.Consumption, total.Coverage)
+		}
+		if !total.End.Equal(time.Date(2026, 7, 1, 13, 0, 0, 0, time.UTC)) {
+			t.Errorf("%s ends %s, want 13:00", total.Period, total.End)
+		}
+	}
+
+	totals := e.Totals()
+	if !near(totals[PerMinute].Consumption, 10) || !near(totals[PerHour].Consumption, 10) {
+		t.Errorf("new minute %g Wh, hour %g Wh, want 10", totals[PerMinute].Consumption, totals[PerHour].Consumption)
+	}
+	if !near(totals[PerDay].Consumption, 20) {
+		t.Errorf("day %g Wh, want 20", totals[PerDay].Consumption)
+	}
+}
+
+func TestEnergyIntegratorGaps(t *testing.T) {
+	start := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	e := NewEnergyIntegrator(time.UTC, 10*time.Second)
+
+	e.Add(sample(start, 3600, 0))
+	e.Add(sample(start.Add(5*time.Second), 3600, 0))  // 5Wh
+	e.Add(sample(start.Add(35*time.Second), 3600, 0)) // Gap longer than maxGap, skipped
+	e.Add(sample(start.Add(40*time.Second), 3600, 0)) // 5Wh
+	e.Add(sample(start.Add(40*time.Second), 9999, 0)) // Duplicate, ignored
+	e.Add(sample(start.Add(39*time.Second), 9999, 0)) // Out of order, ignored
+	e.Reset()
+	e.Add(sample(start.Add(45*time.Second), 3600, 0)) // After a reset, nothing to integrate
+
+	// The gap still rolls periods over
+	completed := e.Add(sample(start.Add(2*time.Minute), 3600, 0))
+	if len(completed) != 1 || completed[0].Period != PerMinute {
+		t.Fatalf("completed %+v, want the first minute", completed)
+	}
+	minute := completed[0]
+	if !near(minute.Consumption, 10) || minute.Coverage != 10*time.Second {
+		t.Errorf("minute %g Wh over %s, want 10 Wh over 10s", minute.Consumption, minute.Coverage)
+	}
+	if got := minute.CoverageRatio(); !near(got, 1.0/6) {
+		t.Errorf("coverage ratio %g, want 1/6", got)
+	}
+}
+
+func TestEnergyIntegratorDST(t *testing.T) {
+	newYork := loadLocation(t, "America/New_York")
+	e := NewEnergyIntegrator(newYork, time.Minute)
+
+	// 1:59:50 EDT to 1:00:10 EST is 20s, crossing into the repeated hour
+	firstOne := time.Date(2026, 11, 1, 1, 0, 0, 0, newYork)
+	secondOne := firstOne.Add(time.Hour)
+	e.Add(sample(secondOne.Add(-10*time.Second), 3600, 0))
+	completed := e.Add(sample(secondOne.Add(10*time.Second), 3600, 0))
+
+	var hour *EnergyTotals
+	for i := range completed {
+		if completed[i].Period == PerHour {
+			hour = &completed[i]
+		}
+	}
+	if hour == nil {
+		t.Fatal("the first 1:00 hour wasn't completed")
+	}
+	if !hour.Start.Equal(firstOne) || !hour.End.Equal(secondOne) {
+		t.Errorf("hour %s to %s, want %s to %s", hour.Start, hour.End, firstOne, secondOne)
+	}
+	if !near(hour.Consumption, 10) {
+		t.Errorf("hour %g Wh, want 10", hour.Consumption)
+	}
+
+	// The day is 25 hours long
+	midnight := time.Date(2026, 11, 2, 0, 0, 0, 0, newYork)
+	e.Add(sample(midnight.Add(-10*time.Second), 3600, 0))
+	completed = e.Add(sample(midnight.Add(10*time.Second), 3600, 0))
+	day := completed[len(completed)-1]
+	if day.Period != PerDay {
+		t.Fatalf("completed %+v, want the day last", completed)
+	}
+	if length := day.End.Sub(day.Start); length != 25*time.Hour {
+		t.Errorf("day is %s long, want 25h", length)
+	}
+	if !near(day.Consumption, 30) || day.Coverage != 30*time.Second {
+		t.Errorf("day %g Wh over %s, want 30 Wh over 30s", day.Consumption, day.Coverage)
+	}
+}
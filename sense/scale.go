@@ -1,6 +1,9 @@
 package sense
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // Scale "enum"
 type Scale int
@@ -35,3 +38,55 @@ func ParseScale(str string) (Scale, error) {
 	}
 	return 0, fmt.Errorf("Invalid Scale: %s", str)
 }
+
+// Next returns the start of the trend step after the one starting at t: minutes for HOUR,
+// hours for DAY, days for WEEK and MONTH and months for YEAR.  Days and months follow the
+// calendar of t's location, so t must be in the monitor's time zone for DST days to come
+// out 23 or 25 hours long.
+func (s Scale) Next(t time.Time) time.Time {
+	switch s {
+	case Hour:
+		return t.Add(time.Minute)
+	case Day:
+		return t.Add(time.Hour)
+	case Week, Month:
+		return t.AddDate(0, 0, 1)
+	default:
+		return t.AddDate(0, 1, 0)
+	}
+}
+
+// Period returns the start of the span a single trend request covers that contains t: the
+// hour for HOUR, the day for DAY and WEEK, the month for MONTH and the year for YEAR, on the
+// calendar of the monitor's location.  Weeks start on the day t falls on.
+func (s Scale) Period(t time.Time, location *time.Location) time.Time {
+	local := t.In(location)
+	switch s {
+	case Hour:
+		return local.Add(-time.Duration(local.Minute())*time.Minute -
+			time.Duration(local.Second())*time.Second - time.Duration(local.Nanosecond()))
+	case Day, Week:
+		return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+	case Month:
+		return time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, location)
+	default:
+		return time.Date(local.Year(), 1, 1, 0, 0, 0, 0, location)
+	}
+}
+
+// NextPeriod returns the start of the request period after the one starting at t, t must
+// come from Period so months never overflow into the following month
+func (s Scale) NextPeriod(t time.Time) time.Time {
+	switch s {
+	case Hour:
+		return t.Add(time.Hour)
+	case Day:
+		return t.AddDate(0, 0, 1)
+	case Week:
+		return t.AddDate(0, 0, 7)
+	case Month:
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.AddDate(1, 0, 0)
+	}
+}
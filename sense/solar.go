@@ -0,0 +1,43 @@
+package sense
+
+// SolarSplit breaks consumption and production down into what came from and went to the
+// grid.  Splits have to be computed per step and then added up, netting totals over a
+// longer period hides the solar exported at midday and imported again at night.
+type SolarSplit struct {
+	GridImport   float64 `json:"gridImport"`
+	GridExport   float64 `json:"gridExport"`
+	SelfConsumed float64 `json:"selfConsumed"` // Production used in the house
+}
+
+// Split nets consumption against production for a single step (or power reading)
+func Split(consumption, production float64) SolarSplit {
+	if consumption >= production {
+		return SolarSplit{GridImport: consumption - production, SelfConsumed: production}
+	}
+	return SolarSplit{GridExport: production - consumption, SelfConsumed: consumption}
+}
+
+// Add sums two splits
+func (s SolarSplit) Add(other SolarSplit) SolarSplit {
+	return SolarSplit{
+		GridImport:   s.GridImport + other.GridImport,
+		GridExport:   s.GridExport + other.GridExport,
+		SelfConsumed: s.SelfConsumed + other.SelfConsumed,
+	}
+}
+
+// SelfSufficiency is the fraction of consumption covered by our own production
+func (s SolarSplit) SelfSufficiency() float64 {
+	if consumption := s.SelfConsumed + s.GridImport; consumption > 0 {
+		return s.SelfConsumed / consumption
+	}
+	return 0
+}
+
+// SelfConsumption is the fraction of production used in the house rather than exported
+func (s SolarSplit) SelfConsumption() float64 {
+	if production := s.SelfConsumed + s.GridExport; production > 0 {
+		return s.SelfConsumed / production
+	}
+	return 0
+}
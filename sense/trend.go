@@ -1,13 +1,11 @@
 package sense
 
 import (
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"strconv"
+	"log/slog"
 	"time"
 
-	"github.com/buger/jsonparser"
 	"github.com/david-lutz/sense_logger/credentials"
 )
 
@@ -21,36 +19,165 @@ type TrendRecord struct {
 	Scale       Scale
 }
 
-// Parse the "start", "end", and "steps" fields in the response
-func parseTimeAndSteps(body []byte) (time.Time, time.Time, int, error) {
-	steps, err := jsonparser.GetInt(body, "steps")
-	if err != nil {
-		return time.Time{}, time.Time{}, 0, err
+// DeviceTrendRecord holds one device's energy (kWh) for one step of the Sense trend report,
+// or for the whole report when Sense only sent the device's total
+type DeviceTrendRecord struct {
+	DeviceID   string
+	Name       string
+	Production bool // A production device (i.e. solar) rather than a consumer
+	Total      bool // Energy is the report's total, timestamped at its start
+	Energy     float64
+	Timestamp  time.Time
+	Scale      Scale
+}
+
+// TrendSeries is the consumption or production part of a trend response, values are kWh
+type TrendSeries struct {
+	Total   float64       `json:"total"`
+	Totals  []float64     `json:"totals"` // Per step, missing (future) steps are zero
+	Devices []TrendDevice `json:"devices"`
+}
+
+// TrendDevice is one device's share of a trend series
+type TrendDevice struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Icon    string    `json:"icon"`
+	Total   float64   `json:"total_kwh"`
+	History []float64 `json:"history"` // Per step kWh, if Sense sends it
+}
+
+// TrendResponse is the decoded Sense trend report.  The grid and solar totals are only
+// present for monitors with solar.
+type TrendResponse struct {
+	Steps        int         `json:"steps"`
+	Start        time.Time   `json:"start"`
+	End          time.Time   `json:"end"`
+	Consumption  TrendSeries `json:"consumption"`
+	Production   TrendSeries `json:"production"`
+	FromGrid     *float64    `json:"from_grid"`     // kWh
+	ToGrid       *float64    `json:"to_grid"`       // kWh
+	SolarPowered *float64    `json:"solar_powered"` // Percent of consumption
+}
+
+// ParseTrendResponse decodes a trend response, checking that every per step array has one
+// value per step.  Production totals may be missing for monitors without solar.
+func ParseTrendResponse(body []byte) (*TrendResponse, error) {
+	var r TrendResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("decoding trend response: %w", err)
+	}
+	if r.Steps <= 0 {
+		return nil, fmt.Errorf("trend response has %d steps", r.Steps)
+	}
+	if r.Start.IsZero() || r.End.IsZero() {
+		return nil, fmt.Errorf("trend response is missing its start or end")
 	}
 
-	startStr, err := jsonparser.GetString(body, "start")
-	if err != nil {
-		return time.Time{}, time.Time{}, 0, err
+	if err := r.Consumption.validate("consumption", r.Steps, true); err != nil {
+		return nil, err
 	}
-	startTime, err := time.Parse(time.RFC3339, startStr)
-	if err != nil {
-		return time.Time{}, time.Time{}, 0, err
+	if err := r.Production.validate("production", r.Steps, false); err != nil {
+		return nil, err
 	}
+	return &r, nil
+}
 
-	endStr, err := jsonparser.GetString(body, "end")
+// DeviceRecords returns one DeviceTrendRecord per step for each device with per step
+// history, timestamped like Records.  Devices with only a total get a single Total record at
+// the start of the report.
+func (r *TrendResponse) DeviceRecords(scale Scale, location *time.Location) ([]DeviceTrendRecord, error) {
+	timestamps, err := trendTimestamps(scale, r.Start, r.End, r.Steps, location)
 	if err != nil {
-		return time.Time{}, time.Time{}, 0, err
+		return nil, err
 	}
-	endTime, err := time.Parse(time.RFC3339, endStr)
-	if err != nil {
-		return time.Time{}, time.Time{}, 0, err
+
+	var results []DeviceTrendRecord
+	for _, series := range []struct {
+		devices    []TrendDevice
+		production bool
+	}{
+		{r.Consumption.Devices, false},
+		{r.Production.Devices, true},
+	} {
+		for _, device := range series.devices {
+			if device.History == nil {
+				results = append(results, DeviceTrendRecord{
+					DeviceID:   device.ID,
+					Name:       device.Name,
+					Production: series.production,
+					Total:      true,
+					Energy:     device.Total,
+					Timestamp:  timestamps[0],
+					Scale:      scale,
+				})
+				continue
+			}
+			for i, energy := range device.History {
+				results = append(results, DeviceTrendRecord{
+					DeviceID:   device.ID,
+					Name:       device.Name,
+					Production: series.production,
+					Energy:     energy,
+					Timestamp:  timestamps[i],
+					Scale:      scale,
+				})
+			}
+		}
 	}
+	return results, nil
+}
 
-	return startTime, endTime, int(steps), nil
+// Check the per step arrays have one value per step
+func (s TrendSeries) validate(name string, steps int, required bool) error {
+	if (required || s.Totals != nil) && len(s.Totals) != steps {
+		return fmt.Errorf("trend response has %d %s totals for %d steps", len(s.Totals), name, steps)
+	}
+	for _, device := range s.Devices {
+		if device.History != nil && len(device.History) != steps {
+			return fmt.Errorf("trend response has %d %s history values for device %q (%s), expected %d",
+				len(device.History), name, device.Name, device.ID, steps)
+		}
+	}
+	return nil
+}
+
+// Value at step i, zero if the series has no per step totals
+func (s TrendSeries) value(i int) float64 {
+	if s.Totals == nil {
+		return 0
+	}
+	return s.Totals[i]
+}
+
+// Generate the start of each step in a trend response, stepping through the monitor's local
+// calendar (see Scale.Next) from start.  Week, Month and Year steps start at local midnight.
+// The steps must land exactly on end, otherwise the values would be given the wrong times.
+func trendTimestamps(scale Scale, start, end time.Time, steps int, location *time.Location) ([]time.Time, error) {
+	if steps <= 0 || !end.After(start) {
+		return nil, fmt.Errorf("%s trend response has %d steps from %s to %s", scale, steps,
+			start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+
+	t := start.In(location)
+	if scale == Week || scale == Month || scale == Year {
+		t = beginningOfDay(t, location)
+	}
+
+	timestamps := make([]time.Time, 0, steps)
+	for t.Before(end) && len(timestamps) <= steps {
+		timestamps = append(timestamps, t)
+		t = scale.Next(t)
+	}
+	if len(timestamps) != steps || !t.Equal(end) {
+		return nil, fmt.Errorf("%s trend response has %d steps from %s to %s, which don't fit the %s calendar",
+			scale, steps, start.Format(time.RFC3339), end.Format(time.RFC3339), location)
+	}
+	return timestamps, nil
 }
 
 // GetTrendData returns the Sense trend data (in what I believe are kWh) for the given start time and Scale.
-func GetTrendData(creds credentials.Credentials, scale Scale, start time.Time, verbose bool) ([]TrendRecord, error) {
+func GetTrendData(creds credentials.Credentials, scale Scale, start time.Time, logger *slog.Logger) ([]TrendRecord, error) {
 
 	// Get the location of the Sense Monitor from the credentials for calculating timestamps
 	location, err := time.LoadLocation(creds.TimeZone)
@@ -58,6 +185,16 @@ func GetTrendData(creds credentials.Credentials, scale Scale, start time.Time, v
 		return nil, err
 	}
 
+	response, err := GetTrendResponse(creds, scale, start, logger)
+	if err != nil {
+		return nil, err
+	}
+	return response.Records(scale, location)
+}
+
+// GetTrendResponse fetches and decodes the full Sense trend report for the given start time
+// and Scale
+func GetTrendResponse(creds credentials.Credentials, scale Scale, start time.Time, logger *slog.Logger) (*TrendResponse, error) {
 	// Validate scale parameter
 	switch scale {
 	case Hour, Day, Week, Month, Year:
@@ -65,106 +202,30 @@ func GetTrendData(creds credentials.Credentials, scale Scale, start time.Time, v
 		return nil, fmt.Errorf("invalid scale: %s", scale)
 	}
 
-	// HTTP Request with "Authorization" header set to the credential token
 	url := fmt.Sprintf(trendURL, creds.MonitorID, scale, start.Format(time.RFC3339))
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("Authorization", fmt.Sprintf("bearer %s", creds.Token))
-	if verbose {
-		fmt.Printf("Request: %v\n", req)
-	}
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		if verbose {
-			fmt.Printf("Error Result: %v\n", res)
-		}
-		return nil, err
-	}
-	if verbose {
-		fmt.Printf("Result: %v\n", res)
-	}
-	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		if verbose {
-			p := make([]byte, 1024)
-			res.Body.Read(p)
-			r := string(p)
-			fmt.Printf("r: %s\n", r)
-		}
-		return nil, fmt.Errorf("status code error: %d %s", res.StatusCode, res.Status)
-	}
-
-	// Slurp in the entire response body
-	body, err := ioutil.ReadAll(res.Body)
+	body, err := apiGet(creds, url, logger)
 	if err != nil {
 		return nil, err
 	}
+	return ParseTrendResponse(body)
+}
 
-	// How many "steps" are we expecting in the data
-	startTime, endTime, steps, err := parseTimeAndSteps(body)
+// Records returns one TrendRecord per step of the response, timestamped on the monitor's
+// local calendar
+func (r *TrendResponse) Records(scale Scale, location *time.Location) ([]TrendRecord, error) {
+	timestamps, err := trendTimestamps(scale, r.Start, r.End, r.Steps, location)
 	if err != nil {
 		return nil, err
 	}
-
-	// Get the timestamps for each trend record.  Hour and Day scales have regular step
-	// durations, but  Week, Month and Year scales can vary
-	results := make([]TrendRecord, steps)
-	switch scale {
-	case Hour, Day:
-		stepSize := endTime.Sub(startTime) / time.Duration(steps)
-		for i := range results {
-			results[i].Timestamp = startTime.Add(time.Duration(i) * stepSize)
-			results[i].Scale = scale
-		}
-
-	case Week, Month:
-		dayStart := beginningOfDay(startTime, location)
-		for i := range results {
-			results[i].Timestamp = dayStart.AddDate(0, 0, i)
-			results[i].Scale = scale
-		}
-
-	case Year:
-		dayStart := beginningOfDay(startTime, location)
-		for i := range results {
-			results[i].Timestamp = dayStart.AddDate(0, i, 0)
-			results[i].Scale = scale
+	results := make([]TrendRecord, r.Steps)
+	for i := range results {
+		results[i] = TrendRecord{
+			Consumption: r.Consumption.value(i),
+			Production:  r.Production.value(i),
+			Timestamp:   timestamps[i],
+			Scale:       scale,
 		}
 	}
-
-	// Parse Consumption Values
-	index := 0
-	var parseErr error
-	jsonparser.ArrayEach(body,
-		func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
-			consumtpion, err := strconv.ParseFloat(string(value), 64)
-			if err != nil && parseErr == nil {
-				parseErr = err
-			}
-			results[index].Consumption = consumtpion
-			index++
-		}, "consumption", "totals")
-	if parseErr != nil {
-		return nil, parseErr
-	}
-
-	// Parse Productions Values
-	index = 0
-	jsonparser.ArrayEach(body,
-		func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
-			production, err := strconv.ParseFloat(string(value), 64)
-			if err != nil && parseErr == nil {
-				parseErr = err
-			}
-			results[index].Production = production
-			index++
-		}, "production", "totals")
-	if parseErr != nil {
-		return nil, parseErr
-	}
-
 	return results, nil
 }
 
@@ -0,0 +1,318 @@
+package sense
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+// DST transitions in 2026 for each test zone, as local dates
+var dstDays = []struct {
+	zone         string
+	springOn     time.Time // Clocks go forward, a 23 hour day
+	skipped      int       // Local hour that doesn't exist
+	fallBackOn   time.Time // Clocks go back, a 25 hour day
+	repeated     int       // Local hour that happens twice
+	springDays   int       // Days in the spring forward month
+	fallBackDays int       // Days in the fall back month
+}{
+	{"America/New_York", date(2026, 3, 8), 2, date(2026, 11, 1), 1, 31, 30},
+	{"Europe/London", date(2026, 3, 29), 1, date(2026, 10, 25), 1, 31, 31},
+	{"Australia/Sydney", date(2026, 10, 4), 2, date(2026, 4, 5), 2, 31, 30},
+}
+
+// A local date, the time zone is applied by the test
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// The same calendar date at local midnight in location
+func midnight(d time.Time, location *time.Location) time.Time {
+	return time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, location)
+}
+
+func TestTrendTimestampsDay(t *testing.T) {
+	for _, zone := range dstDays {
+		location := loadLocation(t, zone.zone)
+		for _, day := range []struct {
+			name    string
+			date    time.Time
+			steps   int
+			skipped int // -1 for none
+			twice   int // -1 for none
+		}{
+			{"spring forward", zone.springOn, 23, zone.skipped, -1},
+			{"fall back", zone.fallBackOn, 25, -1, zone.repeated},
+			{"normal", zone.springOn.AddDate(0, 0, -7), 24, -1, -1},
+		} {
+			start := midnight(day.date, location)
+			end := start.AddDate(0, 0, 1)
+			name := zone.zone + " " + day.name
+
+			timestamps, err := trendTimestamps(Day, start.UTC(), end.UTC(), day.steps, location)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			if len(timestamps) != day.steps {
+				t.Errorf("%s: %d timestamps, want %d", name, len(timestamps), day.steps)
+				continue
+			}
+
+			// Every step is an hour long in absolute time
+			hours := make(map[int]int)
+			for i, ts := range timestamps {
+				if want := start.Add(time.Duration(i) * time.Hour); !ts.Equal(want) {
+					t.Errorf("%s: step %d at %s, want %s", name, i, ts, want)
+				}
+				if ts.Location() != location {
+					t.Errorf("%s: step %d in %s, want %s", name, i, ts.Location(), location)
+				}
+				hours[ts.Hour()]++
+			}
+
+			// And the local hours show the DST change
+			for hour := 0; hour < 24; hour++ {
+				want := 1
+				switch hour {
+				case day.skipped:
+					want = 0
+				case day.twice:
+					want = 2
+				}
+				if hours[hour] != want {
+					t.Errorf("%s: local hour %d seen %d times, want %d", name, hour, hours[hour], want)
+				}
+			}
+		}
+	}
+}
+
+// WEEK and MONTH steps are days and YEAR steps are months, all starting at local midnight
+func TestTrendTimestampsCalendar(t *testing.T) {
+	for _, zone := range dstDays {
+		location := loadLocation(t, zone.zone)
+		for _, test := range []struct {
+			name  string
+			scale Scale
+			start time.Time
+			end   time.Time
+			steps int
+		}{
+			{"week over spring forward", Week, zone.springOn.AddDate(0, 0, -3), zone.springOn.AddDate(0, 0, 4), 7},
+			{"week over fall back", Week, zone.fallBackOn.AddDate(0, 0, -3), zone.fallBackOn.AddDate(0, 0, 4), 7},
+			{"spring forward month", Month, date(zone.springOn.Year(), zone.springOn.Month(), 1),
+				date(zone.springOn.Year(), zone.springOn.Month()+1, 1), zone.springDays},
+			{"fall back month", Month, date(zone.fallBackOn.Year(), zone.fallBackOn.Month(), 1),
+				date(zone.fallBackOn.Year(), zone.fallBackOn.Month()+1, 1), zone.fallBackDays},
+			{"year", Year, date(2026, 1, 1), date(2027, 1, 1), 12},
+		} {
+			start := midnight(test.start, location)
+			end := midnight(test.end, location)
+			name := zone.zone + " " + test.name
+
+			timestamps, err := trendTimestamps(test.scale, start.UTC(), end.UTC(), test.steps, location)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			if len(timestamps) != test.steps {
+				t.Errorf("%s: %d timestamps, want %d", name, len(timestamps), test.steps)
+				continue
+			}
+			for i, ts := range timestamps {
+				want := start.AddDate(0, 0, i)
+				if test.scale == Year {
+					want = start.AddDate(0, i, 0)
+				}
+				if !ts.Equal(want) || ts.Hour() != 0 || ts.Minute() != 0 {
+					t.Errorf("%s: step %d at %s, want %s", name, i, ts, want)
+				}
+			}
+		}
+	}
+}
+
+// Start times that aren't local midnight are moved back to it for WEEK, MONTH and YEAR
+func TestTrendTimestampsMidnight(t *testing.T) {
+	location := loadLocation(t, "America/New_York")
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, location)
+	end := time.Date(2026, 4, 1, 0, 0, 0, 0, location)
+
+	timestamps, err := trendTimestamps(Month, start.Add(5*time.Hour), end, 31, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !timestamps[0].Equal(start) {
+		t.Errorf("first step at %s, want %s", timestamps[0], start)
+	}
+}
+
+func TestTrendTimestampsRejected(t *testing.T) {
+	newYork := loadLocation(t, "America/New_York")
+	sydney := loadLocation(t, "Australia/Sydney")
+	springForward := time.Date(2026, 3, 8, 0, 0, 0, 0, newYork)
+	fallBack := time.Date(2026, 11, 1, 0, 0, 0, 0, newYork)
+	march := time.Date(2026, 3, 1, 0, 0, 0, 0, newYork)
+
+	for _, test := range []struct {
+		name     string
+		scale    Scale
+		start    time.Time
+		end      time.Time
+		steps    int
+		location *time.Location
+	}{
+		{"24 steps on a 23 hour day", Day, springForward, springForward.AddDate(0, 0, 1), 24, newYork},
+		{"24 steps on a 25 hour day", Day, fallBack, fallBack.AddDate(0, 0, 1), 24, newYork},
+		{"26 steps on a 25 hour day", Day, fallBack, fallBack.AddDate(0, 0, 1), 26, newYork},
+		{"end between steps", Day, springForward, springForward.Add(22*time.Hour + 30*time.Minute), 23, newYork},
+		{"30 days in March", Month, march, march.AddDate(0, 1, 0), 30, newYork},
+		{"11 months in a year", Year, march, march.AddDate(1, 0, 0), 11, newYork},
+		{"60 minutes in an hour", Hour, march, march.Add(time.Hour), 59, newYork},
+		{"month in the wrong zone", Month, march, march.AddDate(0, 1, 0), 31, sydney},
+		{"no steps", Day, springForward, springForward.AddDate(0, 0, 1), 0, newYork},
+		{"end before start", Day, springForward, springForward.Add(-time.Hour), 1, newYork},
+	} {
+		timestamps, err := trendTimestamps(test.scale, test.start, test.end, test.steps, test.location)
+		if err == nil {
+			t.Errorf("%s: expected an error, got %d timestamps", test.name, len(timestamps))
+			continue
+		}
+		if !strings.Contains(err.Error(), test.scale.String()) {
+			t.Errorf("%s: error %q doesn't name the scale", test.name, err)
+		}
+	}
+}
+
+func TestScaleNext(t *testing.T) {
+	newYork := loadLocation(t, "America/New_York")
+	london := loadLocation(t, "Europe/London")
+	sydney := loadLocation(t, "Australia/Sydney")
+
+	for _, test := range []struct {
+		name  string
+		scale Scale
+		t     time.Time
+		want  time.Time
+	}{
+		{"minute", Hour, time.Date(2026, 3, 8, 1, 59, 0, 0, newYork), time.Date(2026, 3, 8, 3, 0, 0, 0, newYork)},
+		{"hour into spring forward", Day, time.Date(2026, 3, 8, 1, 0, 0, 0, newYork), time.Date(2026, 3, 8, 3, 0, 0, 0, newYork)},
+		{"hour into fall back", Day, time.Date(2026, 10, 25, 1, 0, 0, 0, london).Add(-time.Hour), time.Date(2026, 10, 25, 1, 0, 0, 0, london)},
+		{"repeated hour", Day, time.Date(2026, 10, 25, 1, 0, 0, 0, london), time.Date(2026, 10, 25, 1, 0, 0, 0, london).Add(time.Hour)},
+		{"23 hour day", Week, time.Date(2026, 10, 4, 0, 0, 0, 0, sydney), time.Date(2026, 10, 5, 0, 0, 0, 0, sydney)},
+		{"25 hour day", Month, time.Date(2026, 11, 1, 0, 0, 0, 0, newYork), time.Date(2026, 11, 2, 0, 0, 0, 0, newYork)},
+		{"month over fall back", Year, time.Date(2026, 4, 1, 0, 0, 0, 0, sydney), time.Date(2026, 5, 1, 0, 0, 0, 0, sydney)},
+		{"month over year end", Year, time.Date(2026, 12, 1, 0, 0, 0, 0, london), time.Date(2027, 1, 1, 0, 0, 0, 0, london)},
+	} {
+		if got := test.scale.Next(test.t); !got.Equal(test.want) {
+			t.Errorf("%s: %s.Next(%s) = %s, want %s", test.name, test.scale, test.t, got, test.want)
+		}
+	}
+
+	// Local days on DST changes are 23 and 25 hours long
+	for _, test := range []struct {
+		day  time.Time
+		want time.Duration
+	}{
+		{time.Date(2026, 3, 8, 0, 0, 0, 0, newYork), 23 * time.Hour},
+		{time.Date(2026, 11, 1, 0, 0, 0, 0, newYork), 25 * time.Hour},
+		{time.Date(2026, 3, 29, 0, 0, 0, 0, london), 23 * time.Hour},
+		{time.Date(2026, 10, 25, 0, 0, 0, 0, london), 25 * time.Hour},
+		{time.Date(2026, 10, 4, 0, 0, 0, 0, sydney), 23 * time.Hour},
+		{time.Date(2026, 4, 5, 0, 0, 0, 0, sydney), 25 * time.Hour},
+	} {
+		if got := Month.Next(test.day).Sub(test.day); got != test.want {
+			t.Errorf("day from %s is %s long, want %s", test.day, got, test.want)
+		}
+	}
+}
+
+func TestDeviceRecords(t *testing.T) {
+	location := loadLocation(t, "America/New_York")
+	response, err := ParseTrendResponse([]byte(`{
+		"steps": 3,
+		"start": "2026-03-01T05:00:00Z",
+		"end": "2026-03-04T05:00:00Z",
+		"consumption": {
+			"total": 60,
+			"totals": [20, 25, 15],
+			"devices": [
+				{"id": "pool", "name": "Pool Pump", "total_kwh": 12, "history": [4, 5, 3]},
+				{"id": "fridge", "name": "Fridge", "total_kwh": 3.5}
+			]
+		},
+		"production": {
+			"total": 30,
+			"totals": [10, 12, 8],
+			"devices": [{"id": "solar", "name": "Solar", "total_kwh": 30}]
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := response.DeviceRecords(Month, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, location)
+	want := []DeviceTrendRecord{
+		{DeviceID: "pool", Name: "Pool Pump", Energy: 4, Timestamp: start, Scale: Month},
+		{DeviceID: "pool", Name: "Pool Pump", Energy: 5, Timestamp: start.AddDate(0, 0, 1), Scale: Month},
+		{DeviceID: "pool", Name: "Pool Pump", Energy: 3, Timestamp: start.AddDate(0, 0, 2), Scale: Month},
+		{DeviceID: "fridge", Name: "Fridge", Total: true, Energy: 3.5, Timestamp: start, Scale: Month},
+		{DeviceID: "solar", Name: "Solar", Production: true, Total: true, Energy: 30, Timestamp: start, Scale: Month},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d: %+v", len(records), len(want), records)
+	}
+	for i, r := range records {
+		w := want[i]
+		if r.DeviceID != w.DeviceID || r.Name != w.Name || r.Production != w.Production || r.Total != w.Total ||
+			r.Energy != w.Energy || !r.Timestamp.Equal(w.Timestamp) || r.Scale != w.Scale {
+			t.Errorf("record %d = %+v, want %+v", i, r, w)
+		}
+	}
+}
+
+func TestScalePeriod(t *testing.T) {
+	newYork := loadLocation(t, "America/New_York")
+	firstOne := time.Date(2026, 11, 1, 1, 0, 0, 0, newYork) // EDT
+	secondOne := firstOne.Add(time.Hour)                    // EST
+
+	for _, test := range []struct {
+		name  string
+		scale Scale
+		t     time.Time
+		want  time.Time
+		next  time.Time
+	}{
+		{"first repeated hour", Hour, firstOne.Add(30 * time.Minute), firstOne, secondOne},
+		{"second repeated hour", Hour, secondOne.Add(30 * time.Minute), secondOne, secondOne.Add(time.Hour)},
+		{"25 hour day", Day, secondOne, time.Date(2026, 11, 1, 0, 0, 0, 0, newYork), time.Date(2026, 11, 2, 0, 0, 0, 0, newYork)},
+		{"week starts on the day", Week, time.Date(2026, 3, 5, 15, 0, 0, 0, newYork),
+			time.Date(2026, 3, 5, 0, 0, 0, 0, newYork), time.Date(2026, 3, 12, 0, 0, 0, 0, newYork)},
+		{"month from the 31st", Month, time.Date(2026, 1, 31, 12, 0, 0, 0, newYork),
+			time.Date(2026, 1, 1, 0, 0, 0, 0, newYork), time.Date(2026, 2, 1, 0, 0, 0, 0, newYork)},
+		{"year", Year, time.Date(2026, 7, 4, 12, 0, 0, 0, time.UTC),
+			time.Date(2026, 1, 1, 0, 0, 0, 0, newYork), time.Date(2027, 1, 1, 0, 0, 0, 0, newYork)},
+	} {
+		period := test.scale.Period(test.t, newYork)
+		if !period.Equal(test.want) {
+			t.Errorf("%s: %s.Period(%s) = %s, want %s", test.name, test.scale, test.t, period, test.want)
+		}
+		if next := test.scale.NextPeriod(period); !next.Equal(test.next) {
+			t.Errorf("%s: %s.NextPeriod(%s) = %s, want %s", test.name, test.scale, period, next, test.next)
+		}
+	}
+}
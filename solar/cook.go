@@ -0,0 +1,279 @@
+package solar
+
+/*
+ * This file holds the production cooking model shared by the realtime and trend loggers.
+ * Even with the inverters off Sense reads a little production, cooking zeroes production
+ * outside daylight, subtracts the idle baseline (fixed or learned from recent nights) and
+ * clamps what is left below the production threshold to zero.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+	"github.com/mitchellh/go-homedir"
+)
+
+const (
+	defaultNights = 7
+	// Nights with less data than this aren't used for the baseline
+	minNightHours = 1.0
+	// Longest gap between realtime samples credited to the later sample
+	maxSampleGap = time.Minute
+)
+
+// Night time readings for one night, keyed by the local date the night starts on
+type night struct {
+	WattHours float64   `json:"wattHours"`
+	Hours     float64   `json:"hours"`
+	Last      time.Time `json:"last"` // End of the last reading, earlier readings are ignored
+}
+
+func (n night) average() float64 {
+	return n.WattHours / n.Hours
+}
+
+// Cooker cooks production readings, it is safe for concurrent use
+type Cooker struct {
+	threshold float64 // Watts
+	baseline  float64 // Watts
+	learn     bool
+	nights    int
+	margin    time.Duration
+	sun       *Sun
+	location  *time.Location
+	stateFile string
+
+	mu      sync.Mutex
+	history map[string]night
+}
+
+// NewCooker builds the cooking model from the config, loading learned nights from the state
+// file if there is one.  Days and nights follow the local calendar in location.
+func NewCooker(cfg *config.Config, location *time.Location) (*Cooker, error) {
+	c := &Cooker{
+		threshold: cfg.Sense.ProductionThreshold,
+		baseline:  cfg.Production.Baseline,
+		learn:     cfg.Production.Learn,
+		nights:    cfg.Production.Nights,
+		margin:    cfg.Production.Margin,
+		location:  location,
+		history:   make(map[string]night),
+	}
+	if c.nights <= 0 {
+		c.nights = defaultNights
+	}
+	if cfg.Solar.Located() {
+		c.sun = &Sun{Latitude: cfg.Solar.Latitude, Longitude: cfg.Solar.Longitude}
+	}
+	if c.learn && c.sun == nil {
+		return nil, fmt.Errorf("learning the production baseline needs the [Solar] latitude and longitude")
+	}
+
+	if c.learn && cfg.Production.StateFile != "" {
+		filename, err := homedir.Expand(cfg.Production.StateFile)
+		if err != nil {
+			return nil, err
+		}
+		c.stateFile = filename
+		history, err := loadHistory(filename)
+		if err != nil {
+			return nil, err
+		}
+		c.history = history
+	}
+	return c, nil
+}
+
+// Learning returns true if the baseline is learned from recent nights
+func (c *Cooker) Learning() bool {
+	return c.learn
+}
+
+// Baseline returns the idle reading (watts) subtracted from production, the median of the
+// recent nights when learning, falling back to the fixed baseline until a night is learned
+func (c *Cooker) Baseline() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.currentBaseline()
+}
+
+func (c *Cooker) currentBaseline() float64 {
+	if !c.learn {
+		return c.baseline
+	}
+
+	keys := make([]string, 0, len(c.history))
+	for key, n := range c.history {
+		if n.Hours >= minNightHours {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return c.baseline
+	}
+	sort.Strings(keys)
+	if len(keys) > c.nights {
+		keys = keys[len(keys)-c.nights:]
+	}
+
+	averages := make([]float64, len(keys))
+	for i, key := range keys {
+		averages[i] = c.history[key].average()
+	}
+	sort.Float64s(averages)
+	middle := len(averages) / 2
+	if len(averages)%2 == 0 {
+		return (averages[middle-1] + averages[middle]) / 2
+	}
+	return averages[middle]
+}
+
+// Night returns true if [start, start+step) is entirely outside the daylight window.  It is
+// always false if the array's location isn't configured.
+func (c *Cooker) Night(start time.Time, step time.Duration) bool {
+	return c.sun != nil && !c.sun.Daylight(start.In(c.location), start.Add(step).In(c.location), c.margin)
+}
+
+// Cook returns the cooked production for an average of watts over [start, start+step), a
+// zero step is a realtime reading at start
+func (c *Cooker) Cook(start time.Time, step time.Duration, watts float64) float64 {
+	if c.Night(start, step) {
+		return 0.0
+	}
+	cooked := watts - c.Baseline()
+	if cooked < c.threshold || cooked < 0 {
+		return 0.0
+	}
+	return cooked
+}
+
+// CookEnergy returns the cooked production for kWh produced over [start, start+step)
+func (c *Cooker) CookEnergy(start time.Time, step time.Duration, kWh float64) float64 {
+	hours := step.Hours()
+	if hours <= 0 {
+		return kWh
+	}
+	return c.Cook(start, step, kWh*1000/hours) * hours / 1000
+}
+
+// Learn records a raw production reading, an average of watts over [start, start+step), if
+// it falls entirely at night.  A zero step is a realtime reading at start.  Readings that end
+// before the last one learned for the night are ignored, so overlapping trend data can be fed
+// in more than once.
+func (c *Cooker) Learn(start time.Time, step time.Duration, watts float64) {
+	if !c.learn || !c.Night(start, step) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := nightOf(start.In(c.location))
+	n := c.history[key]
+	end := start.Add(step)
+	if !end.After(n.Last) {
+		return
+	}
+
+	// Realtime readings stand for the time since the previous one
+	if step == 0 {
+		step = maxSampleGap
+		if !n.Last.IsZero() && start.Sub(n.Last) < step {
+			step = start.Sub(n.Last)
+		}
+	}
+	n.WattHours += watts * step.Hours()
+	n.Hours += step.Hours()
+	n.Last = end
+	c.history[key] = n
+	c.prune()
+}
+
+// Nights start on the local date of the evening, so the small hours belong to the day before
+func nightOf(local time.Time) string {
+	if local.Hour() < 12 {
+		local = local.AddDate(0, 0, -1)
+	}
+	return local.Format("2006-01-02")
+}
+
+// Forget nights that can no longer be used, keeping one spare for the night in progress
+func (c *Cooker) prune() {
+	if len(c.history) <= c.nights+1 {
+		return
+	}
+	keys := make([]string, 0, len(c.history))
+	for key := range c.history {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys[:len(keys)-c.nights-1] {
+		delete(c.history, key)
+	}
+}
+
+// Save writes the learned nights to the state file, if there is one.  Nights saved by
+// another logger since we loaded are merged, keeping whichever copy covers more of the night.
+func (c *Cooker) Save() error {
+	if c.stateFile == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	saved, err := loadHistory(c.stateFile)
+	if err != nil {
+		return err
+	}
+	for key, n := range saved {
+		if mine, ok := c.history[key]; !ok || n.Hours > mine.Hours {
+			c.history[key] = n
+		}
+	}
+	c.prune()
+
+	data, err := json.MarshalIndent(c.history, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write a temporary file and rename it over the state file, so readers never see a
+	// partial file
+	tmp, err := os.CreateTemp(filepath.Dir(c.stateFile), filepath.Base(c.stateFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.stateFile)
+}
+
+// A missing state file is an empty history
+func loadHistory(filename string) (map[string]night, error) {
+	history := make(map[string]night)
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("production state file %s: %w", filename, err)
+	}
+	return history, nil
+}
@@ -0,0 +1,180 @@
+package solar
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+)
+
+func newTestCooker(t *testing.T, learn bool) *Cooker {
+	t.Helper()
+	cfg := &config.Config{
+		Solar: config.SolarConfig{Latitude: denver.Latitude, Longitude: denver.Longitude},
+		Production: config.ProductionConfig{
+			Baseline: 10,
+			Learn:    learn,
+			Nights:   3,
+			Margin:   30 * time.Minute,
+		},
+	}
+	cfg.Sense.ProductionThreshold = 5
+	c, err := NewCooker(cfg, loadLocation(t, "America/Denver"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCurrentBaseline(t *testing.T) {
+	tests := []struct {
+		name    string
+		learn   bool
+		history map[string]night
+		want    float64
+	}{
+		{"fixed", false, map[string]night{"2026-07-01": {WattHours: 200, Hours: 10}}, 10},
+		{"nothing learned", true, nil, 10},
+		{"too short", true, map[string]night{"2026-07-01": {WattHours: 10, Hours: 0.5}}, 10},
+		{"odd median", true, map[string]night{
+			"2026-07-01": {WattHours: 300, Hours: 10},
+			"2026-07-02": {WattHours: 100, Hours: 10},
+			"2026-07-03": {WattHours: 180, Hours: 9},
+		}, 20},
+		{"even median", true, map[string]night{
+			"2026-07-01": {WattHours: 300, Hours: 10},
+			"2026-07-02": {WattHours: 100, Hours: 10},
+			"2026-07-03": {WattHours: 5, Hours: 0.25}, // Too short, not counted
+		}, 20},
+		{"last nights only", true, map[string]night{
+			"2026-06-28": {WattHours: 900, Hours: 10}, // Older than the last 3 nights
+			"2026-06-29": {WattHours: 900, Hours: 10},
+			"2026-06-30": {WattHours: 100, Hours: 10},
+			"2026-07-01": {WattHours: 200, Hours: 10},
+			"2026-07-02": {WattHours: 400, Hours: 10},
+			"2026-07-03": {WattHours: 40, Hours: 0.5}, // In progress, too short
+		}, 20},
+	}
+	for _, test := range tests {
+		c := newTestCooker(t, test.learn)
+		for key, n := range test.history {
+			c.history[key] = n
+		}
+		if got := c.Baseline(); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: baseline %g, want %g", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNightOf(t *testing.T) {
+	mountain := loadLocation(t, "America/Denver")
+	tests := []struct {
+		local time.Time
+		want  string
+	}{
+		{time.Date(2026, 7, 1, 21, 0, 0, 0, mountain), "2026-07-01"},
+		{time.Date(2026, 7, 1, 23, 59, 0, 0, mountain), "2026-07-01"},
+		{time.Date(2026, 7, 2, 0, 0, 0, 0, mountain), "2026-07-01"},
+		{time.Date(2026, 7, 2, 4, 30, 0, 0, mountain), "2026-07-01"},
+		{time.Date(2026, 7, 2, 11, 59, 0, 0, mountain), "2026-07-01"},
+		{time.Date(2026, 7, 2, 12, 0, 0, 0, mountain), "2026-07-02"},
+		{time.Date(2026, 3, 1, 2, 0, 0, 0, mountain), "2026-02-28"},
+		{time.Date(2026, 1, 1, 1, 0, 0, 0, mountain), "2025-12-31"},
+	}
+	for _, test := range tests {
+		if got := nightOf(test.local); got != test.want {
+			t.Errorf("%s: night of %s, want %s", test.local, got, test.want)
+		}
+	}
+}
+
+func TestLearn(t *testing.T) {
+	mountain := loadLocation(t, "America/Denver")
+	c := newTestCooker(t, true)
+	evening := time.Date(2026, 7, 1, 23, 0, 0, 0, mountain)
+	small := time.Date(2026, 7, 2, 1, 0, 0, 0, mountain)
+
+	steps := []struct {
+		name  string
+		start time.Time
+		step  time.Duration
+		watts float64
+	}{
+		{"daylight, ignored", time.Date(2026, 7, 1, 12, 0, 0, 0, mountain), time.Minute, 1000},
+		{"evening trend minute", evening, time.Minute, 12},
+		{"small hours trend minute", small, time.Minute, 18},
+		{"realtime inside the trend minute, ignored", small.Add(30 * time.Second), 0, 999},
+		{"realtime 30s after the trend minute", small.Add(90 * time.Second), 0, 24},
+		{"trend minute fed again, ignored", small, time.Minute, 999},
+		{"overlapping trend minute, ignored", small.Add(30 * time.Second), time.Minute, 999},
+		{"realtime after a gap, credited maxSampleGap", small.Add(10 * time.Minute), 0, 6},
+		{"next trend minute", small.Add(11 * time.Minute), time.Minute, 30},
+	}
+	for _, step := range steps {
+		c.Learn(step.start, step.step, step.watts)
+	}
+
+	if len(c.history) != 1 {
+		t.Fatalf("learned %d nights, want 1: %v", len(c.history), c.history)
+	}
+	n, ok := c.history["2026-07-01"]
+	if !ok {
+		t.Fatalf("small hours not keyed to the evening before: %v", c.history)
+	}
+	wantHours := (1 + 1 + 0.5 + 1 + 1) / 60.0
+	wantWattHours := (12 + 18 + 24*0.5 + 6 + 30) / 60.0
+	if math.Abs(n.Hours-wantHours) > 1e-9 || math.Abs(n.WattHours-wantWattHours) > 1e-9 {
+		t.Errorf("learned %g Wh over %g h, want %g Wh over %g h", n.WattHours, n.Hours, wantWattHours, wantHours)
+	}
+	if want := small.Add(12 * time.Minute); !n.Last.Equal(want) {
+		t.Errorf("last reading ends %s, want %s", n.Last, want)
+	}
+}
+
+func TestLearnPrune(t *testing.T) {
+	mountain := loadLocation(t, "America/Denver")
+	c := newTestCooker(t, true)
+	for day := 1; day <= 6; day++ {
+		c.Learn(time.Date(2026, 7, day, 1, 0, 0, 0, mountain), time.Hour, 10)
+	}
+
+	// 3 nights plus one spare for the night in progress
+	if len(c.history) != 4 {
+		t.Errorf("kept %d nights, want 4: %v", len(c.history), c.history)
+	}
+	if _, ok := c.history["2026-07-01"]; ok {
+		t.Error("oldest kept night should be 2026-07-02")
+	}
+}
+
+func TestCook(t *testing.T) {
+	mountain := loadLocation(t, "America/Denver")
+	noon := time.Date(2026, 7, 1, 12, 0, 0, 0, mountain)
+	night := time.Date(2026, 7, 1, 1, 0, 0, 0, mountain)
+	c := newTestCooker(t, false)
+
+	tests := []struct {
+		name  string
+		start time.Time
+		step  time.Duration
+		watts float64
+		want  float64
+	}{
+		{"daylight", noon, time.Minute, 2010, 2000},
+		{"realtime", noon, 0, 2010, 2000},
+		{"below the threshold", noon, time.Minute, 14, 0},
+		{"below the baseline", noon, time.Minute, 4, 0},
+		{"night", night, time.Minute, 2010, 0},
+	}
+	for _, test := range tests {
+		if got := c.Cook(test.start, test.step, test.watts); got != test.want {
+			t.Errorf("%s: cooked %g, want %g", test.name, got, test.want)
+		}
+	}
+
+	// 2.01 kWh over an hour is 2010W, less the 10W baseline
+	if got := c.CookEnergy(noon, time.Hour, 2.01); math.Abs(got-2) > 1e-9 {
+		t.Errorf("cooked energy %g kWh, want 2", got)
+	}
+}
@@ -0,0 +1,129 @@
+package solar
+
+/*
+ * This file estimates clear-sky production for the array.  Direct irradiance follows the
+ * Meinel air mass model (with the Kasten-Young air mass), diffuse irradiance is a fixed
+ * fraction of direct, and both are transposed onto the tilted panels with an isotropic sky
+ * and ground reflection.  It ignores weather, shading and temperature, so real output falls
+ * short of it on all but the best days; what matters is how far short.
+ */
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/david-lutz/sense_logger/config"
+)
+
+const (
+	solarConstant   = 1353.0 // W/m², as used by the Meinel model
+	diffuseFraction = 0.1    // Clear-sky diffuse irradiance as a fraction of direct
+	albedo          = 0.2    // Ground reflectance
+	standardIrr     = 1000.0 // W/m² at which panel capacity is rated
+	defaultDerate   = 0.86
+	defaultAzimuth  = 180.0 // Facing south
+
+	// Expected energy is integrated over samples this far apart
+	modelSampleStep = 5 * time.Minute
+	// Performance ratios aren't rated when less than this fraction of capacity is expected,
+	// around sunrise and sunset small errors make the ratio meaningless
+	minRatedFraction = 0.05
+)
+
+// Model estimates clear-sky production for the array
+type Model struct {
+	sun      Sun
+	capacity float64 // kW
+	tilt     float64
+	azimuth  float64
+	derate   float64
+}
+
+// NewModel builds the model from the config, returns nil if the array's capacity isn't
+// configured
+func NewModel(cfg config.SolarConfig) (*Model, error) {
+	if cfg.Capacity <= 0 {
+		return nil, nil
+	}
+	if !cfg.Located() {
+		return nil, fmt.Errorf("solar performance tracking needs the [Solar] latitude and longitude")
+	}
+
+	m := &Model{
+		sun:      Sun{Latitude: cfg.Latitude, Longitude: cfg.Longitude},
+		capacity: cfg.Capacity,
+		tilt:     cfg.Tilt,
+		azimuth:  defaultAzimuth,
+		derate:   cfg.Derate,
+	}
+	// 0 is a valid azimuth (facing north), so only a missing one gets the default
+	if cfg.Azimuth != nil {
+		m.azimuth = *cfg.Azimuth
+	}
+	if m.derate <= 0 {
+		m.derate = defaultDerate
+	}
+	return m, nil
+}
+
+// Irradiance returns the clear-sky irradiance (W/m²) on the plane of the panels at t
+func (m *Model) Irradiance(t time.Time) float64 {
+	elevation, azimuth := m.sun.Position(t)
+	if elevation <= 0 {
+		return 0
+	}
+	zenith := 90 - elevation
+	cosZenith := math.Cos(rad(zenith))
+
+	airMass := 1 / (cosZenith + 0.50572*math.Pow(96.07995-zenith, -1.6364))
+	direct := solarConstant * math.Pow(0.7, math.Pow(airMass, 0.678))
+	diffuse := diffuseFraction * direct
+	global := direct*cosZenith + diffuse
+
+	// Angle between the sun and the panel normal
+	tilt := rad(m.tilt)
+	cosIncidence := cosZenith*math.Cos(tilt) +
+		math.Sin(rad(zenith))*math.Sin(tilt)*math.Cos(rad(azimuth-m.azimuth))
+
+	irradiance := diffuse*(1+math.Cos(tilt))/2 + global*albedo*(1-math.Cos(tilt))/2
+	if cosIncidence > 0 {
+		irradiance += direct * cosIncidence
+	}
+	return irradiance
+}
+
+// Power returns the clear-sky production (kW) at t
+func (m *Model) Power(t time.Time) float64 {
+	return m.capacity * m.Irradiance(t) / standardIrr * m.derate
+}
+
+// Energy returns the clear-sky production (kWh) over [start, end)
+func (m *Model) Energy(start, end time.Time) float64 {
+	var kWh float64
+	for t := start; t.Before(end); t = t.Add(modelSampleStep) {
+		step := modelSampleStep
+		if remaining := end.Sub(t); remaining < step {
+			step = remaining
+		}
+		kWh += m.Power(t.Add(step/2)) * step.Hours()
+	}
+	return kWh
+}
+
+// Performance compares actual production with the clear-sky expectation over a period
+type Performance struct {
+	Expected float64 // kWh
+	Ratio    float64 // Actual over expected, only meaningful if Rated
+	Rated    bool    // Enough production was expected to rate the period
+}
+
+// Performance compares actual production (kWh) over [start, end) with the clear-sky model
+func (m *Model) Performance(start, end time.Time, actual float64) Performance {
+	p := Performance{Expected: m.Energy(start, end)}
+	if p.Expected >= m.capacity*end.Sub(start).Hours()*minRatedFraction {
+		p.Ratio = actual / p.Expected
+		p.Rated = true
+	}
+	return p
+}
@@ -0,0 +1,126 @@
+package solar
+
+/*
+ * This file computes the sun's position and sunrise/sunset times for a location, using the
+ * NOAA solar calculator equations (good to about a minute for sunrise and sunset).
+ */
+
+import (
+	"math"
+	"time"
+)
+
+// Zenith angle at sunrise and sunset, allowing for refraction and the size of the sun
+const sunriseZenith = 90.833
+
+// Sun computes the sun's position for a location (degrees, north and east positive)
+type Sun struct {
+	Latitude  float64
+	Longitude float64
+}
+
+func rad(deg float64) float64 { return deg * math.Pi / 180 }
+func deg(rad float64) float64 { return rad * 180 / math.Pi }
+
+// Declination (degrees) and equation of time (minutes) at t
+func declination(t time.Time) (float64, float64) {
+	jd := float64(t.Unix())/86400 + 2440587.5
+	jc := (jd - 2451545) / 36525
+
+	meanLong := math.Mod(280.46646+jc*(36000.76983+jc*0.0003032), 360)
+	meanAnom := 357.52911 + jc*(35999.05029-0.0001537*jc)
+	ecc := 0.016708634 - jc*(0.000042037+0.0000001267*jc)
+	center := math.Sin(rad(meanAnom))*(1.914602-jc*(0.004817+0.000014*jc)) +
+		math.Sin(rad(2*meanAnom))*(0.019993-0.000101*jc) +
+		math.Sin(rad(3*meanAnom))*0.000289
+	appLong := meanLong + center - 0.00569 - 0.00478*math.Sin(rad(125.04-1934.136*jc))
+	meanObliq := 23 + (26+(21.448-jc*(46.815+jc*(0.00059-jc*0.001813)))/60)/60
+	obliq := meanObliq + 0.00256*math.Cos(rad(125.04-1934.136*jc))
+
+	decl := deg(math.Asin(math.Sin(rad(obliq)) * math.Sin(rad(appLong))))
+	y := math.Pow(math.Tan(rad(obliq/2)), 2)
+	eqTime := 4 * deg(y*math.Sin(2*rad(meanLong))-
+		2*ecc*math.Sin(rad(meanAnom))+
+		4*ecc*y*math.Sin(rad(meanAnom))*math.Cos(2*rad(meanLong))-
+		0.5*y*y*math.Sin(4*rad(meanLong))-
+		1.25*ecc*ecc*math.Sin(2*rad(meanAnom)))
+	return decl, eqTime
+}
+
+// Position returns the sun's elevation above the horizon and its azimuth (clockwise from
+// north), in degrees, at t
+func (s Sun) Position(t time.Time) (float64, float64) {
+	decl, eqTime := declination(t)
+	utc := t.UTC()
+	minutes := float64(utc.Hour()*60+utc.Minute()) + float64(utc.Second())/60
+	solarTime := math.Mod(minutes+eqTime+4*s.Longitude, 1440)
+	if solarTime < 0 {
+		solarTime += 1440
+	}
+	hourAngle := solarTime/4 - 180
+
+	lat, dec := rad(s.Latitude), rad(decl)
+	cosZenith := math.Sin(lat)*math.Sin(dec) + math.Cos(lat)*math.Cos(dec)*math.Cos(rad(hourAngle))
+	zenith := math.Acos(math.Max(-1, math.Min(1, cosZenith)))
+
+	var azimuth float64
+	if denom := math.Cos(lat) * math.Sin(zenith); denom != 0 {
+		cosAz := (math.Sin(lat)*math.Cos(zenith) - math.Sin(dec)) / denom
+		azimuth = deg(math.Acos(math.Max(-1, math.Min(1, cosAz))))
+		if hourAngle > 0 {
+			azimuth = math.Mod(azimuth+180, 360)
+		} else {
+			azimuth = math.Mod(540-azimuth, 360)
+		}
+	}
+	return 90 - deg(zenith), azimuth
+}
+
+// SunriseSunset returns sunrise and sunset on the local calendar day containing date.  In
+// polar night both are the end of the day, in midnight sun they are the start and end.
+func (s Sun) SunriseSunset(date time.Time) (time.Time, time.Time) {
+	location := date.Location()
+	start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, location)
+	end := time.Date(date.Year(), date.Month(), date.Day()+1, 0, 0, 0, 0, location)
+
+	// Evaluate the sun's path at local solar noon
+	noonUTC := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, time.UTC).
+		Add(time.Duration(-4*s.Longitude) * time.Minute)
+	decl, eqTime := declination(noonUTC)
+
+	lat, dec := rad(s.Latitude), rad(decl)
+	cosHA := math.Cos(rad(sunriseZenith))/(math.Cos(lat)*math.Cos(dec)) - math.Tan(lat)*math.Tan(dec)
+	switch {
+	case cosHA > 1: // Sun never rises
+		return end, end
+	case cosHA < -1: // Sun never sets
+		return start, end
+	}
+	hourAngle := deg(math.Acos(cosHA))
+
+	midnightUTC := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	noon := 720 - 4*s.Longitude - eqTime // Minutes after UTC midnight
+	sunrise := midnightUTC.Add(time.Duration((noon - 4*hourAngle) * float64(time.Minute)))
+	sunset := midnightUTC.Add(time.Duration((noon + 4*hourAngle) * float64(time.Minute)))
+	return sunrise.In(location), sunset.In(location)
+}
+
+// Daylight returns true if any of [start, end) falls between sunrise and sunset, widened
+// by margin on each side.  An empty interval checks the instant start.
+func (s Sun) Daylight(start, end time.Time, margin time.Duration) bool {
+	if !end.After(start) {
+		end = start.Add(time.Nanosecond)
+	}
+	// Check each local day the interval touches, plus the day before in case the margin
+	// carries the previous sunset past midnight
+	for day := start.AddDate(0, 0, -1); day.Before(end.AddDate(0, 0, 1)); day = day.AddDate(0, 0, 1) {
+		sunrise, sunset := s.SunriseSunset(day)
+		if sunrise.Equal(sunset) {
+			continue
+		}
+		if start.Before(sunset.Add(margin)) && end.After(sunrise.Add(-margin)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package solar
+
+import (
+	"testing"
+	"time"
+)
+
+var (
+	denver = Sun{Latitude: 39.74, Longitude: -104.99}
+	tromso = Sun{Latitude: 69.65, Longitude: 18.96}
+)
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone data: %v", err)
+	}
+	return location
+}
+
+// The NOAA equations are good to about a minute, allow a little more
+func nearTime(a, b time.Time) bool {
+	diff := a.Sub(b)
+	return diff > -3*time.Minute && diff < 3*time.Minute
+}
+
+func TestSunriseSunset(t *testing.T) {
+	mountain := loadLocation(t, "America/Denver")
+	oslo := loadLocation(t, "Europe/Oslo")
+
+	tests := []struct {
+		name            string
+		sun             Sun
+		date            time.Time
+		sunrise, sunset time.Time
+	}{
+		{"summer solstice", denver, time.Date(2026, 6, 21, 15, 0, 0, 0, mountain),
+			time.Date(2026, 6, 21, 5, 32, 0, 0, mountain), time.Date(2026, 6, 21, 20, 31, 0, 0, mountain)},
+		{"winter solstice", denver, time.Date(2026, 12, 21, 0, 0, 0, 0, mountain),
+			time.Date(2026, 12, 21, 7, 18, 0, 0, mountain), time.Date(2026, 12, 21, 16, 39, 0, 0, mountain)},
+		{"polar night", tromso, time.Date(2026, 12, 21, 12, 0, 0, 0, oslo),
+			time.Date(2026, 12, 22, 0, 0, 0, 0, oslo), time.Date(2026, 12, 22, 0, 0, 0, 0, oslo)},
+		{"midnight sun", tromso, time.Date(2026, 6, 21, 12, 0, 0, 0, oslo),
+			time.Date(2026, 6, 21, 0, 0, 0, 0, oslo), time.Date(2026, 6, 22, 0, 0, 0, 0, oslo)},
+	}
+	for _, test := range tests {
+		sunrise, sunset := test.sun.SunriseSunset(test.date)
+		if !nearTime(sunrise, test.sunrise) || !nearTime(sunset, test.sunset) {
+			t.Errorf("%s: %s to %s, want %s to %s", test.name, sunrise, sunset, test.sunrise, test.sunset)
+		}
+		if sunrise.Location() != test.date.Location() {
+			t.Errorf("%s: sunrise in %s, want %s", test.name, sunrise.Location(), test.date.Location())
+		}
+	}
+}
+
+func TestDaylight(t *testing.T) {
+	mountain := loadLocation(t, "America/Denver")
+	oslo := loadLocation(t, "Europe/Oslo")
+	// Denver's sunset is about 02:31 UTC in June, 23:31 in this zone, so a margin carries it
+	// past midnight into the next local day
+	late := time.FixedZone("late", -3*60*60)
+
+	tests := []struct {
+		name       string
+		sun        Sun
+		start, end time.Time
+		margin     time.Duration
+		want       bool
+	}{
+		{"noon", denver, time.Date(2026, 6, 21, 12, 0, 0, 0, mountain), time.Date(2026, 6, 21, 13, 0, 0, 0, mountain), 0, true},
+		{"midnight", denver, time.Date(2026, 6, 21, 0, 0, 0, 0, mountain), time.Date(2026, 6, 21, 1, 0, 0, 0, mountain), 0, false},
+		{"instant", denver, time.Date(2026, 6, 21, 12, 0, 0, 0, mountain), time.Time{}, 0, true},
+		{"hour containing sunrise", denver, time.Date(2026, 6, 21, 5, 0, 0, 0, mountain), time.Date(2026, 6, 21, 6, 0, 0, 0, mountain), 0, true},
+		{"before sunrise", denver, time.Date(2026, 6, 21, 5, 0, 0, 0, mountain), time.Date(2026, 6, 21, 5, 15, 0, 0, mountain), 0, false},
+		{"margin before sunrise", denver, time.Date(2026, 6, 21, 5, 0, 0, 0, mountain), time.Date(2026, 6, 21, 5, 15, 0, 0, mountain), 30 * time.Minute, true},
+		{"after sunset", denver, time.Date(2026, 6, 21, 20, 45, 0, 0, mountain), time.Date(2026, 6, 21, 21, 0, 0, 0, mountain), 0, false},
+		{"margin after sunset", denver, time.Date(2026, 6, 21, 20, 45, 0, 0, mountain), time.Date(2026, 6, 21, 21, 0, 0, 0, mountain), 30 * time.Minute, true},
+		{"margin past midnight", denver, time.Date(2026, 6, 22, 0, 15, 0, 0, late), time.Date(2026, 6, 22, 0, 20, 0, 0, late), time.Hour, true},
+		{"no margin past midnight", denver, time.Date(2026, 6, 22, 0, 15, 0, 0, late), time.Date(2026, 6, 22, 0, 20, 0, 0, late), 0, false},
+		{"beyond the margin past midnight", denver, time.Date(2026, 6, 22, 0, 45, 0, 0, late), time.Date(2026, 6, 22, 1, 0, 0, 0, late), time.Hour, false},
+		{"polar night", tromso, time.Date(2026, 12, 21, 12, 0, 0, 0, oslo), time.Date(2026, 12, 21, 13, 0, 0, 0, oslo), 30 * time.Minute, false},
+		{"midnight sun", tromso, time.Date(2026, 6, 21, 0, 0, 0, 0, oslo), time.Date(2026, 6, 21, 1, 0, 0, 0, oslo), 0, true},
+	}
+	for _, test := range tests {
+		if got := test.sun.Daylight(test.start, test.end, test.margin); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
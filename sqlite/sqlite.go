@@ -0,0 +1,316 @@
+package sqlite
+
+/*
+ * This file writes Sense trend and realtime data and the device inventory to an embedded
+ * SQLite database, rolls old realtime rows up into per minute rows, and reads back daily
+ * usage.  Times are stored as Unix microseconds.
+ */
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/david-lutz/sense_logger/sense"
+	"github.com/david-lutz/sense_logger/store"
+	_ "modernc.org/sqlite" // Pure Go driver, registers "sqlite"
+)
+
+// Suffix of the table holding per minute rollups of a realtime table
+const minuteSuffix = "_minute"
+
+// DailyUsage holds one local calendar day of trend totals (kWh), Solar is split per row
+type DailyUsage struct {
+	Date        time.Time
+	Consumption float64
+	Production  float64
+	Net         float64
+	Solar       sense.SolarSplit
+}
+
+// Store writes rows for a single Sense monitor
+type Store struct {
+	db        *sql.DB
+	monitorID int64
+
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+// Open (or create) the database file
+func Open(filename string, monitorID int64) (*Store, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)", filename)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // SQLite only allows one writer anyway
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{
+		db:        db,
+		monitorID: monitorID,
+		created:   make(map[string]bool),
+	}, nil
+}
+
+// Close the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// WriteTrend upserts trend rows into the table, creating it if needed
+func (s *Store) WriteTrend(ctx context.Context, table string, rows []store.TrendRow) error {
+	values := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		values[i] = row.Values(s.monitorID, row.Time.UnixMicro())
+	}
+	return s.upsert(ctx, table, store.TrendColumns, values)
+}
+
+// WriteRealTime upserts realtime rows into the table, creating it if needed
+func (s *Store) WriteRealTime(ctx context.Context, table string, rows []store.RealTimeRow) error {
+	values := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		values[i] = row.Values(s.monitorID, row.Time.UnixMicro())
+	}
+	return s.upsert(ctx, table, store.RealTimeColumns, values)
+}
+
+// Rollup averages realtime rows older than before into per minute rows in the "<table>_minute"
+// table, then deletes them.  Minutes that were already rolled up are merged, weighted by the
+// number of samples.  Returns the number of realtime rows rolled up.
+func (s *Store) Rollup(ctx context.Context, table string, before time.Time) (int64, error) {
+	minuteTable := table + minuteSuffix
+	if err := s.ensureTable(ctx, table, store.RealTimeColumns, ""); err != nil {
+		return 0, err
+	}
+	if err := s.ensureTable(ctx, minuteTable, store.RealTimeColumns, "samples INTEGER NOT NULL"); err != nil {
+		return 0, err
+	}
+
+	// Only roll up whole minutes
+	cutoff := before.Truncate(time.Minute).UnixMicro()
+	values := store.RealTimeColumns[2:]
+	averages := make([]string, len(values))
+	merges := make([]string, len(values))
+	for i, column := range values {
+		averages[i] = fmt.Sprintf("AVG(%s)", column)
+		merges[i] = fmt.Sprintf("%s = (%s * samples + excluded.%s * excluded.samples) / (samples + excluded.samples)",
+			column, column, column)
+	}
+	rollup := fmt.Sprintf(`INSERT INTO %s (time, monitor_id, samples, %s)
+SELECT (time / 60000000) * 60000000 AS minute, monitor_id, COUNT(*), %s
+FROM %s WHERE time < ? GROUP BY monitor_id, minute
+ON CONFLICT (monitor_id, time) DO UPDATE SET %s, samples = samples + excluded.samples`,
+		quote(minuteTable), strings.Join(values, ", "), strings.Join(averages, ", "),
+		quote(table), strings.Join(merges, ", "))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, rollup, cutoff); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE time < ?", quote(table)), cutoff)
+	if err != nil {
+		return 0, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+// DailyUsage totals trend rows from the table by local calendar day, for days starting in
+// [start, end).  Days without any rows are left out.
+func (s *Store) DailyUsage(ctx context.Context, table string, location *time.Location, start, end time.Time) ([]DailyUsage, error) {
+	if err := s.ensureTable(ctx, table, store.TrendColumns, ""); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		fmt.Sprintf("SELECT time, consumption, production FROM %s WHERE monitor_id = ? AND time >= ? AND time < ? ORDER BY time",
+			quote(table)),
+		s.monitorID, start.UnixMicro(), end.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []DailyUsage
+	for rows.Next() {
+		var t int64
+		var consumption, production float64
+		if err := rows.Scan(&t, &consumption, &production); err != nil {
+			return nil, err
+		}
+
+		local := time.UnixMicro(t).In(location)
+		date := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+		if len(days) == 0 || !days[len(days)-1].Date.Equal(date) {
+			days = append(days, DailyUsage{Date: date})
+		}
+		day := &days[len(days)-1]
+		day.Consumption += consumption
+		day.Production += production
+		day.Net += consumption - production
+		day.Solar = day.Solar.Add(sense.Split(consumption, production))
+	}
+	return days, rows.Err()
+}
+
+// TrendRows reads back trend rows from the table for [start, end)
+func (s *Store) TrendRows(ctx context.Context, table string, start, end time.Time) ([]store.TrendRow, error) {
+	if err := s.ensureTable(ctx, table, store.TrendColumns, ""); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		fmt.Sprintf("SELECT time, consumption, raw_production, production FROM %s WHERE monitor_id = ? AND time >= ? AND time < ? ORDER BY time",
+			quote(table)),
+		s.monitorID, start.UnixMicro(), end.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []store.TrendRow
+	for rows.Next() {
+		var t int64
+		var row store.TrendRow
+		if err := rows.Scan(&t, &row.Consumption, &row.RawProduction, &row.Production); err != nil {
+			return nil, err
+		}
+		row.Time = time.UnixMicro(t)
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+// WriteDevices replaces the monitor's devices in the table with devices, creating it if
+// needed.  Tags are stored as JSON.
+func (s *Store) WriteDevices(ctx context.Context, table string, devices []sense.Device, updated time.Time) error {
+	create := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	monitor_id INTEGER NOT NULL,
+	id TEXT NOT NULL,
+	name TEXT,
+	type TEXT,
+	make TEXT,
+	model TEXT,
+	icon TEXT,
+	tags TEXT,
+	updated INTEGER NOT NULL,
+	PRIMARY KEY (monitor_id, id)
+) WITHOUT ROWID`, quote(table))
+	if _, err := s.db.ExecContext(ctx, create); err != nil {
+		return fmt.Errorf("creating table %s: %w", table, err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE monitor_id = ?", quote(table)), s.monitorID); err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (monitor_id, id, name, type, make, model, icon, tags, updated) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		quote(table)))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, device := range devices {
+		tags, err := json.Marshal(device.Tags)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.ExecContext(ctx, s.monitorID, device.ID, device.Name, device.Type(),
+			device.Make, device.Model, device.Icon, string(tags), updated.UnixMicro())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Insert rows in a single transaction, replacing existing rows with the same time and monitor
+func (s *Store) upsert(ctx context.Context, table string, columns []string, values [][]interface{}) error {
+	if len(values) == 0 {
+		return nil
+	}
+	if err := s.ensureTable(ctx, table, columns, ""); err != nil {
+		return err
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	insert := fmt.Sprintf("INSERT OR REPLACE INTO %s (%s) VALUES (%s)",
+		quote(table), strings.Join(columns, ", "), placeholders)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, insert)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range values {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Create the table the first time we use it.  The first two columns are always time and
+// monitor_id and form the primary key, the rest are reals.
+func (s *Store) ensureTable(ctx context.Context, table string, columns []string, extra string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.created[table] {
+		return nil
+	}
+
+	defs := []string{"time INTEGER NOT NULL", "monitor_id INTEGER NOT NULL"}
+	if extra != "" {
+		defs = append(defs, extra)
+	}
+	for _, column := range columns[2:] {
+		defs = append(defs, column+" REAL")
+	}
+	defs = append(defs, "PRIMARY KEY (monitor_id, time)")
+
+	sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n) WITHOUT ROWID",
+		quote(table), strings.Join(defs, ",\n\t"))
+	if _, err := s.db.ExecContext(ctx, sql); err != nil {
+		return fmt.Errorf("creating table %s: %w", table, err)
+	}
+
+	s.created[table] = true
+	return nil
+}
+
+// Quote an identifier
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,50 @@
+package store
+
+/*
+ * This file defines the rows shared by the SQL (PostgreSQL and SQLite) stores.
+ */
+
+import "time"
+
+// TrendRow is one trend record, Production is the "cooked" production value
+type TrendRow struct {
+	Time          time.Time
+	Consumption   float64
+	RawProduction float64
+	Production    float64
+}
+
+// RealTimeRow is one realtime data point, Production is the "cooked" production value
+type RealTimeRow struct {
+	Time                time.Time
+	VoltageA            float64
+	VoltageB            float64
+	Frequency           float64
+	ConsumptionChannelA float64
+	ConsumptionChannelB float64
+	ProductionChannelA  float64
+	ProductionChannelB  float64
+	Consumption         float64
+	Production          float64
+	ProductionRaw       float64
+}
+
+// TrendColumns are the trend table columns, the first two form the primary key
+var TrendColumns = []string{"time", "monitor_id", "consumption", "raw_production", "production"}
+
+// RealTimeColumns are the realtime table columns, the first two form the primary key
+var RealTimeColumns = []string{"time", "monitor_id", "voltage_a", "voltage_b", "frequency",
+	"consumption_channel_a", "consumption_channel_b", "production_channel_a", "production_channel_b",
+	"consumption", "production", "production_raw"}
+
+// Values returns the row's values in TrendColumns order, t is the time in the store's format
+func (r TrendRow) Values(monitorID int64, t interface{}) []interface{} {
+	return []interface{}{t, monitorID, r.Consumption, r.RawProduction, r.Production}
+}
+
+// Values returns the row's values in RealTimeColumns order, t is the time in the store's format
+func (r RealTimeRow) Values(monitorID int64, t interface{}) []interface{} {
+	return []interface{}{t, monitorID, r.VoltageA, r.VoltageB, r.Frequency,
+		r.ConsumptionChannelA, r.ConsumptionChannelB, r.ProductionChannelA, r.ProductionChannelB,
+		r.Consumption, r.Production, r.ProductionRaw}
+}